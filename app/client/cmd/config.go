@@ -0,0 +1,49 @@
+package main
+
+import (
+	"client/internal/chat/chatwebsocket"
+	"envconfig"
+	"time"
+)
+
+type Config struct {
+	envconfig.Vault
+	ServerAddr        string        `config:"serverOutsideAddr" vault:"true" required:"true" usage:"server address"`
+	ChatId            int           `config:"chatId" flag:"chat" usage:"id of the chat to join"`
+	Name              string        `config:"name" usage:"user name to log in with"`
+	Password          string        `config:"password" secret:"true" usage:"user password"`
+	Register          bool          `config:"register" usage:"register new user before logging in"`
+	PingInterval      time.Duration `config:"pingInterval" usage:"how often server is pinged"`
+	PongWait          time.Duration `config:"pongWait" usage:"how long to wait for anything from server before treating connection as lost"`
+	ReconnectMin      time.Duration `config:"reconnectMinDelay" usage:"delay before the first reconnect attempt, it doubles with every failed one"`
+	ReconnectMax      time.Duration `config:"reconnectMaxDelay" usage:"max delay between reconnect attempts"`
+	ReconnectAttempts int           `config:"reconnectAttempts" usage:"reconnect attempts before giving up, 0 means forever"`
+}
+
+// vault is not used unless vaultAddr is given, client is run outside of compose, so it is the published port then,
+// e.g. http://localhost:8200, credentials are given by CHAT_VAULT_ or VAULT_TOKEN variables
+func defaultConfig() Config {
+	return Config{
+		Vault:             envconfig.Vault{VaultMount: envconfig.DefaultVaultMount},
+		PingInterval:      chatwebsocket.DefaultHeartbeatConfig.PingInterval,
+		PongWait:          chatwebsocket.DefaultHeartbeatConfig.PongWait,
+		ReconnectMin:      chatwebsocket.DefaultReconnectConfig.MinDelay,
+		ReconnectMax:      chatwebsocket.DefaultReconnectConfig.MaxDelay,
+		ReconnectAttempts: chatwebsocket.DefaultReconnectConfig.MaxAttempts,
+	}
+}
+
+func (cfg Config) heartbeatConfig() chatwebsocket.HeartbeatConfig {
+	return chatwebsocket.HeartbeatConfig{PingInterval: cfg.PingInterval, PongWait: cfg.PongWait}
+}
+
+func (cfg Config) reconnectConfig() chatwebsocket.ReconnectConfig {
+	return chatwebsocket.ReconnectConfig{MinDelay: cfg.ReconnectMin, MaxDelay: cfg.ReconnectMax, MaxAttempts: cfg.ReconnectAttempts}
+}
+
+func (cfg Config) Validate() error {
+	if e := cfg.heartbeatConfig().Validate(); e != nil {
+		return e
+	}
+	return cfg.reconnectConfig().Validate()
+}
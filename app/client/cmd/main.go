@@ -2,23 +2,48 @@ package main
 
 import (
 	client "client/internal/app"
+	"client/internal/chat/chatwebsocket"
 	"envconfig"
+	"flag"
 	"log"
 	"net/url"
+	"os"
+	"strconv"
 
 	"go.uber.org/zap"
 )
 
 func main() {
+	cfg := defaultConfig()
+	ld, e := envconfig.NewLoader(flag.CommandLine, &cfg)
+	if e != nil {
+		log.Fatal(e)
+	}
+	flag.Parse()
+
+	e = ld.Load()
+	if flag.Arg(0) == "config" {
+		ld.Print(os.Stdout)
+	}
+	if e != nil {
+		log.Fatal(e)
+	}
+	if flag.Arg(0) == "config" {
+		return
+	}
+
 	lg, e := zap.NewProduction()
 	if e != nil {
 		log.Fatal("Failed to init logger")
 	}
 
-	es := envconfig.NewEnvClientStorage()
+	token, user, e := chatwebsocket.Login(cfg.ServerAddr, cfg.Name, cfg.Password, cfg.Register)
+	if e != nil {
+		lg.Fatal("Failed to log in", zap.Error(e), zap.String("user name", cfg.Name))
+	}
 
-	u := url.URL{Scheme: "ws", Host: es.EnvGetAddr("serverOutsideAddr"), Path: "/"}
-	if e = client.RunClient(u.String(), lg); e != nil {
+	u := url.URL{Scheme: "ws", Host: cfg.ServerAddr, Path: "/", RawQuery: url.Values{"chat_id": {strconv.Itoa(cfg.ChatId)}}.Encode()}
+	if e = client.RunClient(u.String(), token, user.Name, cfg.heartbeatConfig(), cfg.reconnectConfig(), lg); e != nil {
 		if e == client.ErrorSigQuit {
 			lg.Info("Client stopped running", zap.Error(e))
 		} else {
@@ -1,6 +1,7 @@
 package client
 
 import (
+	ichat "client/internal/chat"
 	"client/internal/chat/chatwebsocket"
 	"context"
 	"errors"
@@ -19,13 +20,16 @@ import (
 var ErrorFailedToReadKeyboard = errors.New("got error during reading client keyboard")
 var ErrorSigQuit = errors.New("client got signal to quit")
 
-func RunClient(sAddr string, lg *zap.Logger) error { // TODO too enormous func
+const HistoryCommand = "/history"
+const HistoryPageAmt = 10
+
+func RunClient(sAddr string, token string, uName string, hb chatwebsocket.HeartbeatConfig, rc chatwebsocket.ReconnectConfig, lg *zap.Logger) error { // TODO too enormous func
 	eg, ctx := errgroup.WithContext(context.Background())
 
 	sigQuit := make(chan os.Signal, 2)
 	signal.Notify(sigQuit, syscall.SIGINT, syscall.SIGTERM)
 
-	chat, e := chatwebsocket.NewChat(ctx, eg, sAddr, lg)
+	chat, e := chatwebsocket.NewChat(ctx, eg, sAddr, token, hb, rc, lg)
 	if e != nil {
 		return e
 	}
@@ -40,21 +44,36 @@ func RunClient(sAddr string, lg *zap.Logger) error { // TODO too enormous func
 		}
 	})
 
-	var uName string = "Undefined"
-	msgsToSend := waitForMessages(ctx, eg, &uName, lg)
+	msgsToSend := waitForMessages(ctx, eg, lg)
 
 	msgsToRecieve := chat.RecieveMessages()
 	eg.Go(func() error {
 		for {
 			select {
 			case m := <-msgsToSend:
-				if e = chat.SendMessage(message.Message{User: uName, Text: m}); e != nil {
+				if m == HistoryCommand {
+					e = chat.RequestHistory(HistoryPageAmt)
+				} else {
+					e = chat.SendMessage(message.Message{User: uName, Text: m})
+				}
+				if e == chatwebsocket.ErrorFailedToWriteMsg { // connection is being restored, user can retry
+					color.Red("Not sent, connection to server is lost")
+					continue
+				}
+				if e != nil {
 					return e
 				}
 			case m, ok := <-msgsToRecieve:
 				if ok {
 					fmt.Println(m.BeautifulPrint())
 				}
+			case ev := <-chat.ConnEvents():
+				switch ev {
+				case ichat.ConnLost:
+					color.Red("Connection to server lost, reconnecting")
+				case ichat.ConnRestored:
+					color.Green("Connection to server restored")
+				}
 			case <-ctx.Done():
 				color.Red("Type enter to close client")
 				chat.CloseConnection()
@@ -85,11 +104,10 @@ func RunClient(sAddr string, lg *zap.Logger) error { // TODO too enormous func
 	return nil
 }
 
-func waitForMessages(ctx context.Context, eg *errgroup.Group, uName *string, lg *zap.Logger) chan string {
-	color.Cyan("Enter your name")
+func waitForMessages(ctx context.Context, eg *errgroup.Group, lg *zap.Logger) chan string {
+	color.Cyan("Type %s to see older messages", HistoryCommand)
 	msgs := make(chan string, 1)
 	var msg string
-	var first bool = true
 	eg.Go(func() error {
 		defer close(msgs)
 		for {
@@ -108,12 +126,7 @@ func waitForMessages(ctx context.Context, eg *errgroup.Group, uName *string, lg
 			}
 
 			lg.Info("Got new message to send to server")
-			if first {
-				*uName = msg
-				first = false
-			} else {
-				msgs <- msg
-			}
+			msgs <- msg
 		}
 	})
 	return msgs
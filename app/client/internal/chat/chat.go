@@ -7,4 +7,13 @@ import (
 type Chat interface {
 	SendMessage(message.Message) error
 	RecieveMessages() chan message.Message
+	RequestHistory(int) error
+	ConnEvents() <-chan ConnEvent
 }
+
+type ConnEvent int
+
+const (
+	ConnLost     ConnEvent = iota // chat is reconnecting, messages can't be sent meanwhile
+	ConnRestored                  // messages missed while reconnecting are replayed
+)
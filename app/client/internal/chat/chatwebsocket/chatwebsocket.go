@@ -1,21 +1,36 @@
 package chatwebsocket
 
 import (
+	"client/internal/chat"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"server/external/message"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/fatih/color"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
 type ChatWebSocket struct {
-	sAddr string
-	conn  *websocket.Conn
-	ctx   context.Context
-	eg    *errgroup.Group
-	lg    *zap.Logger
+	sAddr        string
+	token        string
+	conn         *websocket.Conn // replaced on reconnect, guarded by mu
+	ctx          context.Context
+	eg           *errgroup.Group
+	lg           *zap.Logger
+	histBeforeId int64 // id of the oldest known message, history is asked before it
+	lastSeenId   int64 // id of the newest known message, missed ones are asked after it on reconnect
+	mu           *sync.Mutex
+	codec        message.FrameCodec
+	hb           HeartbeatConfig
+	rc           ReconnectConfig
+	events       chan chat.ConnEvent
 }
 
 var ErrorFailedToEstConnection error = errors.New("failed to established connection with server")
@@ -27,73 +42,188 @@ var ErrorFailedToGetMsg error = errors.New("error occured during getting message
 var ErrorUnexpectedMsgType error = errors.New("got unexpected message type from server (not equal to websocket.TextMessage)")
 var ErrorServerClosedConnection error = errors.New("server closed connection to client")
 
-func NewChat(ctx context.Context, eg *errgroup.Group, sA string, lg *zap.Logger) (ChatWebSocket, error) {
-	conn, _, e := websocket.DefaultDialer.Dial(sA, nil) // dialcontext? hmm
+func NewChat(ctx context.Context, eg *errgroup.Group, sA string, token string, hb HeartbeatConfig, rc ReconnectConfig, lg *zap.Logger) (*ChatWebSocket, error) {
+	ch := &ChatWebSocket{sAddr: sA, token: token, ctx: ctx, eg: eg, lg: lg, mu: &sync.Mutex{}, hb: hb, rc: rc, events: make(chan chat.ConnEvent, EventsBufSize)}
+	conn, e := ch.dial()
 	if e != nil {
-		lg.Error("Failed to init websocket connection", zap.Error(e), zap.String("server addr", sA))
-		return ChatWebSocket{}, ErrorFailedToEstConnection
+		return nil, e
 	}
+	ch.conn = conn
+	ch.codec = message.NewClientCodec(conn.Subprotocol())
+	return ch, nil
+}
+
+func (ch *ChatWebSocket) getConn() *websocket.Conn {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.conn
+}
+
+// sends buf with the current connection, it fails while client is reconnecting
+func (ch *ChatWebSocket) writeBuf(buf []byte) error {
+	conn := ch.getConn()
+	conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	return conn.WriteMessage(websocket.TextMessage, buf)
+}
 
-	return ChatWebSocket{sAddr: sA, conn: conn, ctx: ctx, eg: eg, lg: lg}, nil
+func newClientId() string {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
 }
 
+// message gets client id if it has none, so server acks can be matched with it
 func (ch *ChatWebSocket) SendMessage(msg message.Message) error {
-	ch.lg.Info("Send message to server", zap.Int("message len", len(msg.Text)), zap.String("message author", msg.User))
-	buf, e := message.EncodeMsgsToBytes(msg)
+	if msg.GetClientId() == "" {
+		msg.SetClientId(newClientId())
+	}
+	ch.lg.Info("Send message to server", zap.Int("message len", len(msg.Text)), zap.String("message author", msg.User), zap.String("client id", msg.GetClientId()))
+	buf, e := ch.codec.EncodeFrame(message.NewMsgFrame(msg))
 	if e != nil {
 		ch.lg.Warn("Failed to encode message to bytes", zap.Error(e), zap.Int("message len", len(msg.Text)), zap.String("message author", msg.User))
 		return ErrorFailedToParseMsg
 	}
 
-	if e = ch.conn.WriteMessage(websocket.TextMessage, buf); e != nil {
+	if e = ch.writeBuf(buf); e != nil {
 		ch.lg.Warn("Failed write message to webscocket conn", zap.Error(e), zap.String("message author", msg.User))
 		return ErrorFailedToWriteMsg
 	}
 	return nil
 }
 
+// asks server for amt messages older than every message got before, they come through RecieveMessages channel
+func (ch *ChatWebSocket) RequestHistory(amt int) error {
+	ch.mu.Lock()
+	bMsgId := ch.histBeforeId
+	ch.mu.Unlock()
+
+	ch.lg.Info("Request history from server", zap.Int64("before message id", bMsgId), zap.Int("amount", amt))
+	buf, e := ch.codec.EncodeFrame(message.NewHistReqFrame(bMsgId, amt))
+	if e != nil {
+		ch.lg.Warn("Failed to encode history request to bytes", zap.Error(e))
+		return ErrorFailedToParseMsg
+	}
+
+	if e = ch.writeBuf(buf); e != nil {
+		ch.lg.Warn("Failed write history request to webscocket conn", zap.Error(e))
+		return ErrorFailedToWriteMsg
+	}
+	return nil
+}
+
+func (ch *ChatWebSocket) updateHistBeforeId(msg message.Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.histBeforeId <= 0 || msg.GetId() < ch.histBeforeId {
+		ch.histBeforeId = msg.GetId()
+	}
+}
+
+func (ch *ChatWebSocket) updateLastSeenId(msgId int64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.lastSeenId = max(ch.lastSeenId, msgId)
+}
+
+func (ch *ChatWebSocket) getLastSeenId() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.lastSeenId
+}
+
+// messages keep coming through the same channel after reconnects
 func (ch *ChatWebSocket) RecieveMessages() chan message.Message {
 	msgs := make(chan message.Message)
 	ch.eg.Go(func() error {
 		defer close(msgs)
 		for {
-			select {
-			case <-ch.ctx.Done():
-				return nil
-			default:
+			e := ch.readConn(ch.getConn(), msgs)
+			if e != ErrorConnectionLost {
+				return e
 			}
 
-			msgT, buf, e := ch.conn.ReadMessage()
-			ch.lg.Info("Received new message from server", zap.Int("message type", msgT))
-			if msgT == websocket.CloseMessage || msgT == -1 { // same problem with msgT as on server TODO
-				ch.lg.Info("Server closed connection")
-				return ErrorServerClosedConnection
-			}
-			if e != nil {
-				ch.lg.Error("Failed to read message from conn", zap.Error(e))
-				return ErrorFailedToGetMsg
+			ch.notify(chat.ConnLost)
+			if e = ch.reconnect(); e != nil {
+				if ch.ctx.Err() != nil {
+					return nil
+				}
+				return e
 			}
-			if msgT != websocket.TextMessage {
-				ch.lg.Warn("Got unexpected message type (not textmessage)", zap.Int("message type", msgT))
-				continue
-			}
-			msg, e := message.DecodeMsgFromBytes(buf)
-			if e != nil {
-				ch.lg.Error("Failed to decode received message", zap.Error(e))
-				return ErrorFailedToParseMsg
-			}
-			msgs <- msg
+			ch.notify(chat.ConnRestored)
 		}
 	})
 	return msgs
 }
 
+// reads conn till it fails, ErrorConnectionLost means it is worth to reconnect
+func (ch *ChatWebSocket) readConn(conn *websocket.Conn, msgs chan message.Message) error {
+	done := ch.startHeartbeat(conn)
+	defer close(done)
+	for {
+		select {
+		case <-ch.ctx.Done():
+			return nil
+		default:
+		}
+
+		msgT, buf, e := conn.ReadMessage()
+		ch.lg.Info("Received new message from server", zap.Int("message type", msgT))
+		if e != nil && ch.ctx.Err() != nil {
+			return nil // connection is closed by client itself
+		}
+		if websocket.IsCloseError(e, websocket.CloseNormalClosure) {
+			ch.lg.Info("Server closed connection")
+			return ErrorServerClosedConnection
+		}
+		if e != nil { // timed out waiting for server, connection broke or server went away
+			ch.lg.Warn("Lost connection to server", zap.Error(e))
+			conn.Close()
+			return ErrorConnectionLost
+		}
+		if msgT != websocket.TextMessage {
+			ch.lg.Warn("Got unexpected message type (not textmessage)", zap.Int("message type", msgT))
+			continue
+		}
+		f, e := ch.codec.DecodeFrame(buf)
+		if e != nil {
+			ch.lg.Error("Failed to decode received message", zap.Error(e))
+			return ErrorFailedToParseMsg
+		}
+
+		switch {
+		case f.Msg != nil:
+			ch.updateHistBeforeId(*f.Msg)
+			ch.updateLastSeenId(f.Msg.GetId())
+			msgs <- *f.Msg
+		case f.HistResp != nil:
+			ch.lg.Info("Received history from server", zap.Int("messages amount", len(f.HistResp.Msgs)), zap.Int64("next before message id", f.HistResp.NextBeforeId))
+			for _, msg := range f.HistResp.Msgs {
+				msgs <- msg
+			}
+			ch.mu.Lock()
+			ch.histBeforeId = f.HistResp.NextBeforeId
+			ch.mu.Unlock()
+		case f.Ack != nil:
+			ch.lg.Info("Server acknowledged message", zap.String("client id", f.Ack.ClientId), zap.String("status", f.Ack.Status), zap.Int64("message id", f.Ack.MsgId))
+			ch.updateLastSeenId(f.Ack.MsgId) // own messages come only as persisted acks
+		case f.Err != nil:
+			ch.lg.Warn("Server rejected frame", zap.String("code", f.Err.Code), zap.String("explanation", f.Err.Text), zap.String("client id", f.Err.ClientId))
+			color.Red("Server error: %s", f.Err.Text)
+		default:
+			ch.lg.Warn("Got empty frame from server")
+		}
+	}
+}
+
 func (ch *ChatWebSocket) CloseConnection() {
-	if e := ch.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Client is shut down")); e != nil {
+	conn := ch.getConn()
+	if e := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Client is shut down"), time.Now().Add(WriteWait)); e != nil {
 		ch.lg.Warn("Failed write close message to webscocket conn", zap.Error(e))
 		// I don't think parent code need that error
 	}
-	if e := ch.conn.Close(); e != nil {
+	if e := conn.Close(); e != nil {
 		ch.lg.Warn("Failed close websocket conn", zap.Error(e))
 		// I don't think parent code need that error
 	}
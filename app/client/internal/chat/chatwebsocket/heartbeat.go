@@ -0,0 +1,67 @@
+package chatwebsocket
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const WriteWait = 10 * time.Second
+
+var ErrorConnectionLost error = errors.New("connection to server lost")
+var ErrorInvalidHeartbeat error = errors.New("ping interval must be positive and less than pong wait")
+
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongWait     time.Duration // server is treated as gone if nothing comes from it for that long
+}
+
+var DefaultHeartbeatConfig = HeartbeatConfig{PingInterval: 20 * time.Second, PongWait: 30 * time.Second}
+
+func (c HeartbeatConfig) Validate() error {
+	if c.PingInterval <= 0 || c.PingInterval >= c.PongWait {
+		return ErrorInvalidHeartbeat
+	}
+	return nil
+}
+
+func (ch *ChatWebSocket) extendReadDeadline(conn *websocket.Conn) error {
+	return conn.SetReadDeadline(time.Now().Add(ch.hb.PongWait))
+}
+
+// both server pings and pongs to our pings prove server is alive, pinging stops once done is closed
+func (ch *ChatWebSocket) startHeartbeat(conn *websocket.Conn) chan struct{} {
+	ch.extendReadDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		return ch.extendReadDeadline(conn)
+	})
+	conn.SetPingHandler(func(data string) error {
+		ch.extendReadDeadline(conn)
+		e := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(WriteWait))
+		if e == websocket.ErrCloseSent {
+			return nil
+		}
+		return e
+	})
+
+	done := make(chan struct{})
+	ch.eg.Go(func() error {
+		ticker := time.NewTicker(ch.hb.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ch.ctx.Done():
+				return nil
+			case <-done:
+				return nil
+			case <-ticker.C:
+				if e := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WriteWait)); e != nil {
+					ch.lg.Warn("Failed to ping server", zap.Error(e))
+				}
+			}
+		}
+	})
+	return done
+}
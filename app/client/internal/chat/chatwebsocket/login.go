@@ -0,0 +1,45 @@
+package chatwebsocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"server/external/account"
+)
+
+var ErrorFailedToLogin error = errors.New("server refused to log in")
+
+type loginResponse struct {
+	Token string       `json:"token"`
+	User  account.User `json:"user"`
+}
+
+// registers user first if register is set, returns token to pass on websocket upgrade
+func Login(sAddr string, name string, password string, register bool) (string, account.User, error) {
+	path := "/login"
+	if register {
+		path = "/register"
+	}
+	resp, e := http.PostForm(fmt.Sprintf("http://%s%s", sAddr, path), url.Values{"name": {name}, "password": {password}})
+	if e != nil {
+		return "", account.User{}, e
+	}
+	defer resp.Body.Close()
+
+	buf, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return "", account.User{}, e
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", account.User{}, fmt.Errorf("%w: %s", ErrorFailedToLogin, buf)
+	}
+
+	var lr loginResponse
+	if e = json.Unmarshal(buf, &lr); e != nil {
+		return "", account.User{}, ErrorFailedToParseResp
+	}
+	return lr.Token, lr.User, nil
+}
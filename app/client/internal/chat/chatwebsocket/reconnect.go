@@ -0,0 +1,99 @@
+package chatwebsocket
+
+import (
+	"client/internal/chat"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"server/external/message"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const EventsBufSize = 4
+
+var ErrorUnauthorized error = errors.New("server refused token, log in again")
+var ErrorInvalidReconnect error = errors.New("reconnect delays must be positive, min delay must not exceed max one")
+
+type ReconnectConfig struct {
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int // 0 means retry till client is shut down
+}
+
+var DefaultReconnectConfig = ReconnectConfig{MinDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second}
+
+func (c ReconnectConfig) Validate() error {
+	if c.MinDelay <= 0 || c.MaxDelay < c.MinDelay || c.MaxAttempts < 0 {
+		return ErrorInvalidReconnect
+	}
+	return nil
+}
+
+// asks server to replay messages after the last seen one if there is any
+func (ch *ChatWebSocket) dial() (*websocket.Conn, error) {
+	u, e := url.Parse(ch.sAddr)
+	if e != nil {
+		return nil, e
+	}
+	if lMsgId := ch.getLastSeenId(); lMsgId > 0 {
+		qs := u.Query()
+		qs.Set("last_message_id", strconv.FormatInt(lMsgId, 10))
+		u.RawQuery = qs.Encode()
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{message.JsonSubprotocol}
+	conn, resp, e := dialer.DialContext(ch.ctx, u.String(), http.Header{"Authorization": {"Bearer " + ch.token}})
+	if e != nil {
+		ch.lg.Error("Failed to init websocket connection", zap.Error(e), zap.String("server addr", ch.sAddr))
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrorUnauthorized
+		}
+		return nil, ErrorFailedToEstConnection
+	}
+	return conn, nil
+}
+
+// waits before every attempt with exponential backoff and jitter, so clients don't come back all together
+func (ch *ChatWebSocket) reconnect() error {
+	delay := ch.rc.MinDelay
+	for attempt := 1; ch.rc.MaxAttempts == 0 || attempt <= ch.rc.MaxAttempts; attempt++ {
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		ch.lg.Info("Reconnect to server", zap.Int("attempt", attempt), zap.Duration("wait", wait))
+		select {
+		case <-ch.ctx.Done():
+			return ch.ctx.Err()
+		case <-time.After(wait):
+		}
+
+		conn, e := ch.dial()
+		if e == ErrorUnauthorized {
+			return e
+		}
+		if e == nil {
+			ch.mu.Lock()
+			ch.conn = conn
+			ch.mu.Unlock()
+			return nil
+		}
+		delay = min(delay*2, ch.rc.MaxDelay)
+	}
+	return ErrorFailedToEstConnection
+}
+
+// events are dropped if nobody reads them
+func (ch *ChatWebSocket) notify(ev chat.ConnEvent) {
+	select {
+	case ch.events <- ev:
+	default:
+	}
+}
+
+func (ch *ChatWebSocket) ConnEvents() <-chan chat.ConnEvent {
+	return ch.events
+}
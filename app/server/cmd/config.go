@@ -0,0 +1,48 @@
+package main
+
+import (
+	"envconfig"
+	"server/internal/ports/websocketport"
+	"time"
+)
+
+type Config struct {
+	envconfig.Vault
+	ServerAddr      string        `config:"serverAddr" vault:"true" required:"true" usage:"address to listen for clients on"`
+	KafkaAddr       string        `config:"kafkaAddr" vault:"true" required:"true" usage:"kafka broker address"`
+	StorageAddr     string        `config:"storageServerAddr" vault:"true" required:"true" usage:"storage service address"`
+	RedisAddr       string        `config:"redisAddr" vault:"true" required:"true" usage:"redis address for presence"`
+	AuthSecret      string        `config:"authSecret" vault:"true" required:"true" secret:"true" usage:"signs user tokens, must be the same for all instances"`
+	OutboxDir       string        `config:"outboxDir" usage:"directory for messages not confirmed by kafka yet, every instance uses its own subdirectory and adopts the ones left by stopped instances"`
+	SendQueueSize   int           `config:"sendQueueSize" usage:"amount of frames queued for every client"`
+	SendQueuePolicy string        `config:"sendQueuePolicy" usage:"what to do with a client whose send queue is full: drop_oldest or disconnect"`
+	PingInterval    time.Duration `config:"pingInterval" usage:"how often clients are pinged"`
+	PongWait        time.Duration `config:"pongWait" usage:"how long to wait for anything from client before evicting it"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Vault:           envconfig.Vault{VaultMount: envconfig.DefaultVaultMount, VaultPoll: envconfig.DefaultPollInterval},
+		OutboxDir:       "outbox",
+		SendQueueSize:   websocketport.DefaultSendQueueConfig.Size,
+		SendQueuePolicy: string(websocketport.DefaultSendQueueConfig.Policy),
+		PingInterval:    websocketport.DefaultHeartbeatConfig.PingInterval,
+		PongWait:        websocketport.DefaultHeartbeatConfig.PongWait,
+	}
+}
+
+func (cfg Config) queueConfig() (websocketport.SendQueueConfig, error) {
+	policy, e := websocketport.ParseFullQueuePolicy(cfg.SendQueuePolicy)
+	return websocketport.SendQueueConfig{Size: cfg.SendQueueSize, Policy: policy}, e
+}
+
+func (cfg Config) heartbeatConfig() websocketport.HeartbeatConfig {
+	return websocketport.HeartbeatConfig{PingInterval: cfg.PingInterval, PongWait: cfg.PongWait}
+}
+
+func (cfg Config) Validate() error {
+	if _, e := cfg.queueConfig(); e != nil {
+		return e
+	}
+	return cfg.heartbeatConfig().Validate()
+}
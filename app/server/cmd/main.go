@@ -1,15 +1,59 @@
+// server accepts websocket clients of chats, it is configured by flags, CHAT_ environment variables,
+// yaml file given by -config and vault, `server config` prints effective config.
 package main
 
 import (
+	"context"
 	"envconfig"
+	"flag"
+	"log"
+	"os"
 	"server/internal/ports/websocketport"
 )
 
 func main() {
-	es := envconfig.NewEnvStorage()
+	cfg := defaultConfig()
+	ld, e := envconfig.NewLoader(flag.CommandLine, &cfg)
+	if e != nil {
+		log.Fatal(e)
+	}
+	flag.Parse()
 
-	websocketport.RunServer(es.EnvGetAddr("serverAddr"), map[string]string{
-		"kafkaAddr":   es.EnvGetAddr("kafkaAddr"),
-		"storageAddr": es.EnvGetAddr("storageServerAddr"),
+	e = ld.Load()
+	if flag.Arg(0) == "config" {
+		ld.Print(os.Stdout)
+		if e != nil {
+			log.Fatal(e)
+		}
+		return
+	}
+	if e != nil {
+		log.Fatal(e)
+	}
+	queueCfg, _ := cfg.queueConfig() // checked by Load
+
+	host, e := os.Hostname()
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	ld.KeepToken(context.Background(), func(e error) {
+		log.Printf("Failed to renew vault token: %v", e)
 	})
+	var watcher websocketport.AddrWatcher
+	if w, ok := ld.Watcher(); ok {
+		watcher = w
+		go w.Run(context.Background(), func(key string, e error) {
+			log.Printf("Failed to watch %s: %v", key, e)
+		})
+	}
+
+	websocketport.RunServer(cfg.ServerAddr, map[string]string{
+		"kafkaAddr":   cfg.KafkaAddr,
+		"storageAddr": cfg.StorageAddr,
+		"redisAddr":   cfg.RedisAddr,
+		"authSecret":  cfg.AuthSecret, // signs user tokens, must be the same for all instances
+		"outboxDir":   cfg.OutboxDir,
+		"instance":    host, // names outbox and notifications consumer group, a stable one lets restarted instance go on from its committed offsets
+	}, queueCfg, cfg.heartbeatConfig(), watcher)
 }
@@ -0,0 +1,34 @@
+package account
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+const MaxNameLen = 15 // messages table keeps names as varchar(15)
+const MinPasswordLen = 8
+const MaxPasswordLen = 72 // bcrypt ignores the rest
+
+var ErrorUserExists error = errors.New("user with this name already exists")
+var ErrorWrongCredentials error = errors.New("wrong user name or password")
+var ErrorInvalidName error = errors.New("user name must be from 1 to 15 characters")
+var ErrorInvalidPassword error = errors.New("password must be from 8 to 72 bytes")
+
+type User struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func NewUser(uId int, name string) User {
+	return User{Id: uId, Name: name}
+}
+
+func ValidateCredentials(name string, password string) error {
+	if l := utf8.RuneCountInString(name); l == 0 || l > MaxNameLen {
+		return ErrorInvalidName
+	}
+	if len(password) < MinPasswordLen || len(password) > MaxPasswordLen {
+		return ErrorInvalidPassword
+	}
+	return nil
+}
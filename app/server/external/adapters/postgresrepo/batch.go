@@ -0,0 +1,185 @@
+package postgresrepo
+
+import (
+	"context"
+	"fmt"
+	"server/external/adapters"
+	"server/external/message"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// postgres allows at most 65535 parameters per statement
+const InsertBatchRows = 1000
+
+var messageColumns = []string{"id", "username", "text", "chatid", "userid", "timestamp", "clientid", "eventid"}
+
+const GetStoredEventsQuery = `SELECT eventid, id FROM messages WHERE eventid = ANY($1)`
+
+// reserves amt ids at once, the last of them is returned
+const ReserveMessageIdsQuery = `INSERT INTO chat_message_ids (chatid, lastid) VALUES ($1, $2)
+ON CONFLICT (chatid) DO UPDATE SET lastid = chat_message_ids.lastid + $2
+RETURNING lastid`
+
+// stores msgs in one transaction and sets their ids, already stored events get ids of the stored messages,
+// if the same event is inserted concurrently the whole batch fails and is expected to be retried
+func (pr *PostgresRepo) AddMessages(msgs []message.Message, mode adapters.BatchMode) error {
+	if mode == adapters.BatchSingle {
+		for i := range msgs {
+			if e := pr.AddMessage(&msgs[i], nil); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	tx, e := pr.pool.Load().Begin(ctx)
+	if e != nil {
+		pr.lg.Error("Failed to begin batch transaction", zap.Error(e))
+		return e
+	}
+	defer tx.Rollback(ctx)
+
+	toInsert, e := pr.assignMessageIds(ctx, tx, msgs)
+	if e != nil {
+		return e
+	}
+
+	rows := make([][]any, 0, len(toInsert))
+	for _, i := range toInsert {
+		m := msgs[i]
+		var eId any
+		if m.GetEventId() != "" {
+			eId = m.GetEventId()
+		}
+		rows = append(rows, []any{m.GetId(), m.User, m.Text, m.GetChatId(), m.GetUserId(), time.Now().UnixMilli(), m.GetClientId(), eId})
+	}
+
+	switch mode {
+	case adapters.BatchCopy:
+		_, e = tx.CopyFrom(ctx, pgx.Identifier{"messages"}, messageColumns, pgx.CopyFromRows(rows))
+	default:
+		e = insertRows(ctx, tx, rows)
+	}
+	if e != nil {
+		pr.lg.Error("Failed to write messages batch", zap.Error(e), zap.Int("batch size", len(rows)), zap.String("mode", string(mode)))
+		return e
+	}
+
+	if e = tx.Commit(ctx); e != nil {
+		pr.lg.Error("Failed to commit messages batch", zap.Error(e), zap.Int("batch size", len(rows)))
+		return e
+	}
+	pr.lg.Debug("Added messages batch", zap.Int("batch size", len(msgs)), zap.Int("inserted", len(rows)), zap.String("mode", string(mode)))
+	return nil
+}
+
+// sets ids of already stored events and reserves ids for the rest chat by chat, returns indexes of messages to insert,
+// chats are locked in ascending order so concurrent batches don't deadlock
+func (pr *PostgresRepo) assignMessageIds(ctx context.Context, tx pgx.Tx, msgs []message.Message) ([]int, error) {
+	eIds := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		if m.GetEventId() != "" {
+			eIds = append(eIds, m.GetEventId())
+		}
+	}
+
+	stored := make(map[string]int64)
+	rows, e := tx.Query(ctx, GetStoredEventsQuery, eIds)
+	if e != nil {
+		pr.lg.Error("Failed to query stored events", zap.Error(e))
+		return nil, e
+	}
+	for rows.Next() {
+		var eId string
+		var id int64
+		if e = rows.Scan(&eId, &id); e != nil {
+			rows.Close()
+			pr.lg.Error("Failed to scan stored events", zap.Error(e))
+			return nil, e
+		}
+		stored[eId] = id
+	}
+	rows.Close()
+	if e = rows.Err(); e != nil {
+		pr.lg.Error("Failed to read stored events", zap.Error(e))
+		return nil, e
+	}
+
+	byChat := make(map[int][]int)
+	dups := make(map[int]int) // index of redelivered message -> index of its first copy in the batch
+	first := make(map[string]int)
+	for i := range msgs {
+		eId := msgs[i].GetEventId()
+		if id, ok := stored[eId]; ok && eId != "" {
+			msgs[i].SetId(id)
+			continue
+		}
+		if j, ok := first[eId]; ok && eId != "" {
+			dups[i] = j
+			continue
+		}
+		first[eId] = i
+		byChat[msgs[i].GetChatId()] = append(byChat[msgs[i].GetChatId()], i)
+	}
+
+	cIds := make([]int, 0, len(byChat))
+	for cId := range byChat {
+		cIds = append(cIds, cId)
+	}
+	slices.Sort(cIds)
+
+	toInsert := make([]int, 0, len(msgs))
+	for _, cId := range cIds {
+		idx := byChat[cId]
+		var lastId int64
+		if e = tx.QueryRow(ctx, ReserveMessageIdsQuery, cId, len(idx)).Scan(&lastId); e != nil {
+			pr.lg.Error("Failed to reserve message ids", zap.Error(e), zap.Int("chat id", cId), zap.Int("amount", len(idx)))
+			return nil, e
+		}
+		for n, i := range idx {
+			msgs[i].SetId(lastId - int64(len(idx)-1-n))
+		}
+		toInsert = append(toInsert, idx...)
+	}
+	for i, j := range dups {
+		msgs[i].SetId(msgs[j].GetId())
+	}
+	return toInsert, nil
+}
+
+func insertRows(ctx context.Context, tx pgx.Tx, rows [][]any) error {
+	for start := 0; start < len(rows); start += InsertBatchRows {
+		chunk := rows[start:min(start+InsertBatchRows, len(rows))]
+		var sb strings.Builder
+		sb.WriteString("INSERT INTO messages (" + strings.Join(messageColumns, ", ") + ") VALUES ")
+		args := make([]any, 0, len(chunk)*len(messageColumns))
+		for r, row := range chunk {
+			if r > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(")
+			for c := range row {
+				if c > 0 {
+					sb.WriteString(", ")
+				}
+				fmt.Fprintf(&sb, "$%d", len(args)+c+1)
+			}
+			sb.WriteString(")")
+			args = append(args, row...)
+		}
+		if _, e := tx.Exec(ctx, sb.String(), args...); e != nil {
+			return e
+		}
+	}
+	return nil
+}
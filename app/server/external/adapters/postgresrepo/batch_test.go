@@ -0,0 +1,77 @@
+package postgresrepo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"server/external/adapters"
+	"server/external/message"
+	"testing"
+	"time"
+
+	"storage/external/event"
+
+	"go.uber.org/zap"
+)
+
+const benchBatchSize = 500
+const benchChats = 10
+
+// benchmarks write to database given by CHAT_TEST_POSTGRES, its schema is migrated, so it should be a scratch one
+func newBenchRepo(b *testing.B) *PostgresRepo {
+	dbAddr := os.Getenv("CHAT_TEST_POSTGRES")
+	if dbAddr == "" {
+		b.Skip("CHAT_TEST_POSTGRES is not set")
+	}
+	ctx := context.Background()
+	pool, err := connect(dbAddr, ctx)
+	if err != nil {
+		b.Skipf("postgres is unavailable: %v", err)
+	}
+	pool.Close()
+
+	mg, err := NewMigrator(ctx, dbAddr, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = mg.Up(ctx, 0)
+	mg.Close(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	db := NewRepo(dbAddr, ctx, zap.NewNop())
+	b.Cleanup(func() { db.CloseRepo() })
+	return db
+}
+
+// messages with new event ids spread over chats which no other run uses
+func newBenchBatch(size int, firstChat int, from int) []message.Message {
+	msgs := make([]message.Message, 0, size)
+	for i := 0; i < size; i++ {
+		m := message.Message{User: "bench", Text: fmt.Sprintf("bench message %d", from+i)}
+		m.SetChatId(firstChat + (from+i)%benchChats)
+		m.SetUserId(1)
+		m.SetEventId(event.NewEventId())
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// compares write modes of storage consumer, every op is one message written as a part of a batch,
+// the same does cmd/writebench for a fixed amount of messages
+func BenchmarkAddMessages(b *testing.B) {
+	db := newBenchRepo(b)
+	for _, mode := range []adapters.BatchMode{adapters.BatchSingle, adapters.BatchInsert, adapters.BatchCopy} {
+		b.Run(string(mode), func(b *testing.B) {
+			firstChat := int(time.Now().UnixNano() % (1 << 30))
+			for written := 0; written < b.N; written += benchBatchSize {
+				b.StopTimer()
+				msgs := newBenchBatch(min(benchBatchSize, b.N-written), firstChat, written)
+				b.StartTimer()
+				if err := db.AddMessages(msgs, mode); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package postgresrepo
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// every storage instance migrates on startup, the lock lets only one of them do it at a time
+const MigrationLockId = 727001
+
+var ErrorBadMigrationName error = errors.New("migration file name must look like 000001_name.up.sql or 000001_name.down.sql")
+var ErrorNoDownMigration error = errors.New("migration has no down file")
+var ErrorUnknownMigration error = errors.New("no migration with such version")
+
+const CreateSchemaMigrationsQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint primary key,
+	name varchar(255) not null,
+	applied timestamptz not null default now()
+)`
+
+const GetAppliedMigrationsQuery = `SELECT version FROM schema_migrations ORDER BY version`
+
+const AddAppliedMigrationQuery = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+
+const DeleteAppliedMigrationQuery = `DELETE FROM schema_migrations WHERE version = $1`
+
+const SchemaMigrationsExistQuery = `SELECT to_regclass('schema_migrations') IS NOT NULL`
+
+// databases created before schema_migrations got their migrations from init-message-db.sh,
+// so applied ones are recognized by what they created
+var legacyMigrationChecks = map[int64]string{
+	1: `SELECT to_regclass('messages') IS NOT NULL`,
+	2: `SELECT to_regclass('chat_message_ids') IS NOT NULL`,
+	3: `SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'messages' AND column_name = 'clientid')`,
+	4: `SELECT to_regclass('users') IS NOT NULL`,
+	5: `SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'messages' AND column_name = 'eventid')`,
+}
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string // empty if migration can't be reverted
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// Migrator keeps a single connection, so the advisory lock is held by the session which migrates
+type Migrator struct {
+	conn       *pgx.Conn
+	migrations []Migration
+	lg         *zap.Logger
+}
+
+func loadMigrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, f := range files {
+		base := strings.TrimPrefix(f, "migrations/")
+		vStr, rest, ok := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(vStr, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorBadMigrationName, base)
+		}
+		name, direction, ok := strings.Cut(strings.TrimSuffix(rest, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("%w: %s", ErrorBadMigrationName, base)
+		}
+		buf, err := migrationFiles.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(buf)
+		} else {
+			m.Down = string(buf)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("%w: version %d has no up file", ErrorBadMigrationName, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+	return migrations, nil
+}
+
+func NewMigrator(ctx context.Context, dbAddr string, lg *zap.Logger) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.Connect(ctx, dbAddr)
+	if err != nil {
+		lg.Error("Failed to connect to postgres for migrations", zap.Error(err))
+		return nil, err
+	}
+	return &Migrator{conn: conn, migrations: migrations, lg: lg}, nil
+}
+
+func (mg *Migrator) Close(ctx context.Context) error {
+	return mg.conn.Close(ctx)
+}
+
+// takes migration lock, prepares schema_migrations and runs fn, the lock is released afterwards
+func (mg *Migrator) locked(ctx context.Context, fn func(applied map[int64]bool) error) error {
+	if _, err := mg.conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, MigrationLockId); err != nil {
+		mg.lg.Error("Failed to take migration lock", zap.Error(err))
+		return err
+	}
+	defer func() {
+		if _, err := mg.conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, MigrationLockId); err != nil {
+			mg.lg.Warn("Failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	var exists bool
+	if err := mg.conn.QueryRow(ctx, SchemaMigrationsExistQuery).Scan(&exists); err != nil {
+		return err
+	}
+	if _, err := mg.conn.Exec(ctx, CreateSchemaMigrationsQuery); err != nil {
+		mg.lg.Error("Failed to create schema_migrations table", zap.Error(err))
+		return err
+	}
+	if !exists {
+		if err := mg.adoptLegacySchema(ctx); err != nil {
+			return err
+		}
+	}
+
+	applied, err := mg.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(applied)
+}
+
+func (mg *Migrator) applied(ctx context.Context) (map[int64]bool, error) {
+	rows, err := mg.conn.Query(ctx, GetAppliedMigrationsQuery)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+// records migrations which were applied by init script before versions were tracked
+func (mg *Migrator) adoptLegacySchema(ctx context.Context) error {
+	for _, m := range mg.migrations {
+		check, ok := legacyMigrationChecks[m.Version]
+		if !ok {
+			return nil
+		}
+		var done bool
+		if err := mg.conn.QueryRow(ctx, check).Scan(&done); err != nil {
+			return err
+		}
+		if !done {
+			return nil
+		}
+		if _, err := mg.conn.Exec(ctx, AddAppliedMigrationQuery, m.Version, m.Name); err != nil {
+			return err
+		}
+		mg.lg.Info("Adopted migration applied before versions were tracked", zap.Int64("version", m.Version), zap.String("name", m.Name))
+	}
+	return nil
+}
+
+// every migration runs in its own transaction together with its version record
+func (mg *Migrator) run(ctx context.Context, m Migration, up bool) error {
+	tx, err := mg.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if up {
+		_, err = tx.Exec(ctx, m.Up)
+		if err == nil {
+			_, err = tx.Exec(ctx, AddAppliedMigrationQuery, m.Version, m.Name)
+		}
+	} else {
+		_, err = tx.Exec(ctx, m.Down)
+		if err == nil {
+			_, err = tx.Exec(ctx, DeleteAppliedMigrationQuery, m.Version)
+		}
+	}
+	if err != nil {
+		mg.lg.Error("Failed to run migration", zap.Error(err), zap.Int64("version", m.Version), zap.String("name", m.Name), zap.Bool("up", up))
+		return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+	}
+	return tx.Commit(ctx)
+}
+
+// applies every migration up to version to, to <= 0 means all of them, returns amount of applied ones
+func (mg *Migrator) Up(ctx context.Context, to int64) (int, error) {
+	n := 0
+	err := mg.locked(ctx, func(applied map[int64]bool) error {
+		for _, m := range mg.migrations {
+			if to > 0 && m.Version > to {
+				break
+			}
+			if applied[m.Version] {
+				continue
+			}
+			if err := mg.run(ctx, m, true); err != nil {
+				return err
+			}
+			mg.lg.Info("Applied migration", zap.Int64("version", m.Version), zap.String("name", m.Name))
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// reverts steps latest applied migrations, returns amount of reverted ones
+func (mg *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	n := 0
+	err := mg.locked(ctx, func(applied map[int64]bool) error {
+		for i := len(mg.migrations) - 1; i >= 0 && n < steps; i-- {
+			m := mg.migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("%w: %d_%s", ErrorNoDownMigration, m.Version, m.Name)
+			}
+			if err := mg.run(ctx, m, false); err != nil {
+				return err
+			}
+			mg.lg.Info("Reverted migration", zap.Int64("version", m.Version), zap.String("name", m.Name))
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// records migrations up to version as applied without running them, the later ones as not applied
+func (mg *Migrator) Force(ctx context.Context, version int64) error {
+	if !slices.ContainsFunc(mg.migrations, func(m Migration) bool { return m.Version == version }) && version != 0 {
+		return ErrorUnknownMigration
+	}
+	return mg.locked(ctx, func(applied map[int64]bool) error {
+		for _, m := range mg.migrations {
+			var err error
+			switch {
+			case m.Version <= version && !applied[m.Version]:
+				_, err = mg.conn.Exec(ctx, AddAppliedMigrationQuery, m.Version, m.Name)
+			case m.Version > version && applied[m.Version]:
+				_, err = mg.conn.Exec(ctx, DeleteAppliedMigrationQuery, m.Version)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (mg *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var st []MigrationStatus
+	err := mg.locked(ctx, func(applied map[int64]bool) error {
+		for _, m := range mg.migrations {
+			st = append(st, MigrationStatus{Migration: m, Applied: applied[m.Version]})
+		}
+		return nil
+	})
+	return st, err
+}
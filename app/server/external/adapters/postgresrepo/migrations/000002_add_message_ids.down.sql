@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP CONSTRAINT messages_pkey;
+ALTER TABLE messages DROP COLUMN id;
+
+DROP TABLE chat_message_ids;
@@ -0,0 +1,15 @@
+CREATE TABLE chat_message_ids (
+    chatid integer primary key,
+    lastid bigint not null
+);
+
+ALTER TABLE messages ADD COLUMN id bigint;
+
+UPDATE messages SET id = numbered.rn
+FROM (SELECT ctid, row_number() OVER (PARTITION BY chatid ORDER BY timestamp) AS rn FROM messages) AS numbered
+WHERE messages.ctid = numbered.ctid;
+
+INSERT INTO chat_message_ids (chatid, lastid) SELECT chatid, MAX(id) FROM messages GROUP BY chatid;
+
+ALTER TABLE messages ALTER COLUMN id SET NOT NULL;
+ALTER TABLE messages ADD PRIMARY KEY (chatid, id);
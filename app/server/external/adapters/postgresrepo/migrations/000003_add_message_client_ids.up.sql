@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN clientid varchar(64) not null default '';
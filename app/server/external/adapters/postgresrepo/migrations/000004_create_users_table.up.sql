@@ -0,0 +1,6 @@
+CREATE TABLE users (
+    id serial primary key,
+    name varchar(15) not null unique,
+    passwordhash bytea not null,
+    created timestamptz not null default now()
+);
@@ -0,0 +1,3 @@
+DROP INDEX messages_eventid_key;
+
+ALTER TABLE messages DROP COLUMN eventid;
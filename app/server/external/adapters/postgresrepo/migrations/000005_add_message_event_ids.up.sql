@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN eventid varchar(64);
+
+CREATE UNIQUE INDEX messages_eventid_key ON messages (eventid);
@@ -2,81 +2,143 @@ package postgresrepo
 
 import (
 	"context"
+	"errors"
+	"net"
 	"server/external/message"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
+const NewerMessagesPageSize = 100
+
+// every query gets its own context, so a stuck one doesn't hold a connection forever
+const QueryTimeout = 5 * time.Second
+
+// repo keeps no state besides the pool, so it is safe to use from many goroutines
 type PostgresRepo struct {
-	conn     *pgx.Conn
-	lg       *zap.Logger
-	ctx      context.Context
-	lMsgTmSt int64
+	pool *atomic.Pointer[pgxpool.Pool] // replaced by Reconnect
+	lg   *zap.Logger
+	ctx  context.Context
 }
 
+// pool size can be set with pool_max_conns parameter of dbAddr
 func NewRepo(dbAddr string, ctx context.Context, lg *zap.Logger) *PostgresRepo {
-	conn, err := pgx.Connect(context.Background(), dbAddr)
+	pool, err := connect(dbAddr, ctx)
 	if err != nil {
 		lg.Fatal("Failed to connect to postgres repo", zap.Error(err))
 	}
-	return &PostgresRepo{conn: conn, lg: lg, ctx: ctx, lMsgTmSt: -1}
+	pr := &PostgresRepo{pool: &atomic.Pointer[pgxpool.Pool]{}, lg: lg, ctx: ctx}
+	pr.pool.Store(pool)
+	return pr
+}
+
+func connect(dbAddr string, ctx context.Context) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(context.Background(), dbAddr)
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cncl := context.WithTimeout(ctx, QueryTimeout)
+	defer cncl()
+	if err = pool.Ping(pingCtx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// switches repo to another database, queries started before keep the old pool, it is closed once they are done.
+// old pool is kept if the new database can't be reached
+func (pr *PostgresRepo) Reconnect(dbAddr string) error {
+	pool, err := connect(dbAddr, pr.ctx)
+	if err != nil {
+		pr.lg.Error("Failed to reconnect to postgres repo", zap.Error(err))
+		return err
+	}
+	old := pr.pool.Swap(pool)
+	go old.Close() // waits for acquired connections
+	pr.lg.Info("Reconnected to postgres repo")
+	return nil
 }
 
-func scanAllMessages(rows pgx.Rows) ([]message.Message, []int64, error) {
+// returns true if err is caused by postgres being unreachable, overloaded or shut down rather than by written data,
+// such queries succeed once postgres is back
+func IsUnavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		case "08", "53", "57": // connection exception, insufficient resources, operator intervention
+			return true
+		}
+		return false
+	}
+	var connErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connErr) || errors.As(err, &netErr) || pgconn.Timeout(err) || pgconn.SafeToRetry(err)
+}
+
+func (pr *PostgresRepo) queryCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(pr.ctx, QueryTimeout)
+}
+
+func scanAllMessages(rows pgx.Rows) ([]message.Message, error) {
 	msgs := make([]message.Message, 0)
-	tStamps := make([]int64, 0)
 	for rows.Next() {
 		var msg message.Message
-		var uId int
-		var tStamp int64
-		if e := rows.Scan(&uId, &msg.User, &msg.Text, &tStamp); e != nil {
-			return []message.Message{}, []int64{}, e
+		var id int64
+		var uId, cId int
+		if e := rows.Scan(&id, &uId, &cId, &msg.ClientId, &msg.User, &msg.Text); e != nil {
+			return []message.Message{}, e
 		}
+		msg.SetId(id)
 		msg.SetUserId(uId)
+		msg.SetChatId(cId)
 		msgs = append(msgs, msg)
-		tStamps = append(tStamps, tStamp)
 	}
 
-	return msgs, tStamps, nil
+	return msgs, nil
 }
 
-const GetNewerMessagesQuery = `SELECT userid, username, text, timestamp FROM messages WHERE timestamp > $1`
+const GetNewerMessagesQuery = `SELECT id, userid, chatid, clientid, username, text FROM messages WHERE chatid = $1 AND id > $2 ORDER BY id LIMIT $3`
 
-// TODO messages with equal timestamp is nearly impossible, and I don't really know what to do if we have 3 such messages - now we will loose them
-func (pr *PostgresRepo) GetNewerMessages() ([]message.Message, error) {
-	rows, e := pr.conn.Query(pr.ctx, GetNewerMessagesQuery, pr.lMsgTmSt)
+// returns at most NewerMessagesPageSize messages, so caller should repeat request with the last got id to get the rest
+func (pr *PostgresRepo) GetNewerMessages(cId int, lMsgId int64) ([]message.Message, error) {
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	rows, e := pr.pool.Load().Query(ctx, GetNewerMessagesQuery, cId, lMsgId, NewerMessagesPageSize)
 	if e != nil {
-		pr.lg.Error("Failed to query messages from repo", zap.Error(e))
+		pr.lg.Error("Failed to query messages from repo", zap.Error(e), zap.Int("chat id", cId), zap.Int64("last message id", lMsgId))
 		return []message.Message{}, e
 	}
 
 	defer rows.Close()
 
-	msgs, ts, e := scanAllMessages(rows)
+	msgs, e := scanAllMessages(rows)
 	if e != nil {
 		pr.lg.Error("Failed to scan messages from repo", zap.Error(e))
 		return []message.Message{}, e
 	}
-	if len(ts) != 0 {
-		pr.lMsgTmSt = ts[len(ts)-1]
-	}
 	return msgs, nil
 }
 
-const GetLastMessagesQuery = `SELECT userid, username, text, timestamp FROM messages ORDER BY timestamp DESC LIMIT $1;`
+const GetLastMessagesQuery = `SELECT id, userid, chatid, clientid, username, text FROM messages WHERE chatid = $1 ORDER BY id DESC LIMIT $2;`
 
-func (pr *PostgresRepo) GetLastKMessages(k int) ([]message.Message, error) {
-	rows, e := pr.conn.Query(pr.ctx, GetLastMessagesQuery, k)
+func (pr *PostgresRepo) GetLastKMessages(cId int, k int) ([]message.Message, error) {
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	rows, e := pr.pool.Load().Query(ctx, GetLastMessagesQuery, cId, k)
 	if e != nil {
-		pr.lg.Error("Failed to query messages from repo", zap.Error(e), zap.Int("Msg amt", k))
+		pr.lg.Error("Failed to query messages from repo", zap.Error(e), zap.Int("chat id", cId), zap.Int("Msg amt", k))
 		return []message.Message{}, e
 	}
 
 	defer rows.Close()
 
-	ms, _, e := scanAllMessages(rows)
+	ms, e := scanAllMessages(rows)
 	if e != nil {
 		pr.lg.Error("Failed to scan messages from repo", zap.Error(e))
 		return []message.Message{}, e
@@ -84,26 +146,72 @@ func (pr *PostgresRepo) GetLastKMessages(k int) ([]message.Message, error) {
 	return ms, nil
 }
 
-const AddMessageQuery = `INSERT INTO messages (username, text, chatid, userid, timestamp) VALUES ($1, $2, $3, $4, $5)`
+const GetOlderMessagesQuery = `SELECT id, userid, chatid, clientid, username, text FROM messages WHERE chatid = $1 AND id < $2 ORDER BY id DESC LIMIT $3;`
 
-func (pr *PostgresRepo) AddMessage(m message.Message) error {
-	pr.lg.Debug("Add message", zap.Int("user id ", m.GetUserId()), zap.Int("chat id", m.GetChatId()))
-	_, e := pr.conn.Exec(context.Background(), AddMessageQuery, m.User, m.Text, m.GetChatId(), m.GetUserId(), time.Now().UnixMilli())
+// returns k messages older than bMsgId from newer to older
+func (pr *PostgresRepo) GetOlderMessages(cId int, bMsgId int64, k int) ([]message.Message, error) {
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	rows, e := pr.pool.Load().Query(ctx, GetOlderMessagesQuery, cId, bMsgId, k)
 	if e != nil {
-		pr.lg.Error("Failed to add message to repo", zap.Error(e), zap.Int("user id", m.GetUserId()), zap.Int("chat id", m.GetChatId()))
-		return e
+		pr.lg.Error("Failed to query messages from repo", zap.Error(e), zap.Int("chat id", cId), zap.Int64("before message id", bMsgId), zap.Int("Msg amt", k))
+		return []message.Message{}, e
 	}
-	return nil
-}
 
-func (pr *PostgresRepo) SetLastMessageTimeStamp(timeSt int64) {
-	pr.lMsgTmSt = timeSt
+	defer rows.Close()
+
+	ms, e := scanAllMessages(rows)
+	if e != nil {
+		pr.lg.Error("Failed to scan messages from repo", zap.Error(e))
+		return []message.Message{}, e
+	}
+	return ms, nil
 }
 
-func (pr *PostgresRepo) GetLastMessageTimeStamp() int64 {
-	return pr.lMsgTmSt
+// chat_message_ids row stays locked till the end of transaction, so ids become visible in the order they were given,
+// already stored event is not inserted again and its id is returned instead
+const AddMessageQuery = `WITH existing AS (
+	SELECT id FROM messages WHERE eventid = $7
+), next_id AS (
+	INSERT INTO chat_message_ids (chatid, lastid) SELECT $3, 1 WHERE NOT EXISTS (SELECT 1 FROM existing)
+	ON CONFLICT (chatid) DO UPDATE SET lastid = chat_message_ids.lastid + 1
+	RETURNING lastid
+), inserted AS (
+	INSERT INTO messages (id, username, text, chatid, userid, timestamp, clientid, eventid) SELECT lastid, $1, $2, $3, $4, $5, $6, $7 FROM next_id
+	ON CONFLICT (eventid) DO NOTHING
+	RETURNING id
+)
+SELECT id FROM inserted UNION ALL SELECT id FROM existing`
+
+// event inserted concurrently by another transaction is neither existing nor inserted for the query, so it is asked once more
+const GetMessageIdByEventQuery = `SELECT id FROM messages WHERE eventid = $1`
+
+func (pr *PostgresRepo) AddMessage(m *message.Message, onStored func(error)) error {
+	pr.lg.Debug("Add message", zap.Int("user id ", m.GetUserId()), zap.Int("chat id", m.GetChatId()), zap.String("event id", m.GetEventId()))
+	var eId any
+	if m.GetEventId() != "" {
+		eId = m.GetEventId()
+	}
+
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	var id int64
+	e := pr.pool.Load().QueryRow(ctx, AddMessageQuery, m.User, m.Text, m.GetChatId(), m.GetUserId(), time.Now().UnixMilli(), m.GetClientId(), eId).Scan(&id)
+	if errors.Is(e, pgx.ErrNoRows) {
+		e = pr.pool.Load().QueryRow(ctx, GetMessageIdByEventQuery, eId).Scan(&id)
+	}
+	if e != nil {
+		pr.lg.Error("Failed to add message to repo", zap.Error(e), zap.Int("user id", m.GetUserId()), zap.Int("chat id", m.GetChatId()))
+		return e
+	}
+	m.SetId(id)
+	if onStored != nil {
+		onStored(nil)
+	}
+	return nil
 }
 
 func (pr *PostgresRepo) CloseRepo() error {
-	return pr.conn.Close(pr.ctx)
+	pr.pool.Load().Close()
+	return nil
 }
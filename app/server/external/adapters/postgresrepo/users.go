@@ -0,0 +1,49 @@
+package postgresrepo
+
+import (
+	"errors"
+	"server/external/account"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+)
+
+const uniqueViolationCode = "23505"
+
+const AddUserQuery = `INSERT INTO users (name, passwordhash) VALUES ($1, $2) RETURNING id`
+
+func (pr *PostgresRepo) AddUser(name string, pHash []byte) (account.User, error) {
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	var uId int
+	e := pr.pool.Load().QueryRow(ctx, AddUserQuery, name, pHash).Scan(&uId)
+	if e != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(e, &pgErr) && pgErr.Code == uniqueViolationCode {
+			return account.User{}, account.ErrorUserExists
+		}
+		pr.lg.Error("Failed to add user to repo", zap.Error(e), zap.String("user name", name))
+		return account.User{}, e
+	}
+	return account.NewUser(uId, name), nil
+}
+
+const GetUserQuery = `SELECT id, passwordhash FROM users WHERE name = $1`
+
+// returns account.ErrorWrongCredentials if there is no user with such name
+func (pr *PostgresRepo) GetUser(name string) (account.User, []byte, error) {
+	ctx, cncl := pr.queryCtx()
+	defer cncl()
+	var uId int
+	var pHash []byte
+	e := pr.pool.Load().QueryRow(ctx, GetUserQuery, name).Scan(&uId, &pHash)
+	if errors.Is(e, pgx.ErrNoRows) {
+		return account.User{}, nil, account.ErrorWrongCredentials
+	}
+	if e != nil {
+		pr.lg.Error("Failed to get user from repo", zap.Error(e), zap.String("user name", name))
+		return account.User{}, nil, e
+	}
+	return account.NewUser(uId, name), pHash, nil
+}
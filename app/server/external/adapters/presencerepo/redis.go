@@ -0,0 +1,83 @@
+package presencerepo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const PresenceTTL = 30 * time.Second
+
+// chat members are kept in sorted set scored by expiration time, so users of crashed instances disappear by themselves
+type RedisPresence struct {
+	client *redis.Client
+	ctx    context.Context
+	lg     *zap.Logger
+}
+
+func NewRepo(dbAddr string, ctx context.Context, lg *zap.Logger) *RedisPresence {
+	client := redis.NewClient(&redis.Options{
+		Addr:     dbAddr,
+		Password: "",
+		DB:       0,
+	})
+	return &RedisPresence{client: client, ctx: ctx, lg: lg.With(zap.String("adapters", "redis presence"))}
+}
+
+func chatKey(cId int) string {
+	return fmt.Sprintf("chat:%d:presence", cId)
+}
+
+func (rp *RedisPresence) Join(cId int, uId int) error {
+	return rp.Refresh(cId, []int{uId})
+}
+
+func (rp *RedisPresence) Leave(cId int, uId int) error {
+	if err := rp.client.ZRem(rp.ctx, chatKey(cId), strconv.Itoa(uId)).Err(); err != nil {
+		rp.lg.Warn("Failed to remove user from chat presence", zap.Error(err), zap.Int("chat id", cId), zap.Int("user id", uId))
+		return err
+	}
+	return nil
+}
+
+func (rp *RedisPresence) Refresh(cId int, uIds []int) error {
+	if len(uIds) == 0 {
+		return nil
+	}
+	expireAt := float64(time.Now().Add(PresenceTTL).UnixMilli())
+	members := make([]redis.Z, len(uIds))
+	for i, uId := range uIds {
+		members[i] = redis.Z{Score: expireAt, Member: strconv.Itoa(uId)}
+	}
+	if err := rp.client.ZAdd(rp.ctx, chatKey(cId), members...).Err(); err != nil {
+		rp.lg.Warn("Failed to refresh chat presence", zap.Error(err), zap.Int("chat id", cId), zap.Int("users amount", len(uIds)))
+		return err
+	}
+	return nil
+}
+
+func (rp *RedisPresence) CountOnline(cId int) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := rp.client.ZRemRangeByScore(rp.ctx, chatKey(cId), "-inf", now).Err(); err != nil {
+		rp.lg.Warn("Failed to drop expired chat presence", zap.Error(err), zap.Int("chat id", cId))
+		return 0, err
+	}
+	amt, err := rp.client.ZCard(rp.ctx, chatKey(cId)).Result()
+	if err != nil {
+		rp.lg.Warn("Failed to count chat presence", zap.Error(err), zap.Int("chat id", cId))
+		return 0, err
+	}
+	return int(amt), nil
+}
+
+func (rp *RedisPresence) ClosePresence() error {
+	if err := rp.client.Close(); err != nil {
+		rp.lg.Error("Failed to close presence repo", zap.Error(err))
+		return err
+	}
+	return nil
+}
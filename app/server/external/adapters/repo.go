@@ -1,12 +1,54 @@
 package adapters
 
-import "server/external/message"
+import (
+	"server/external/account"
+	"server/external/message"
+)
 
 type Repository interface {
-	AddMessage(message.Message) error
-	GetNewerMessages() ([]message.Message, error)
-	GetLastKMessages(int) ([]message.Message, error)
-	SetLastMessageTimeStamp(int64)
-	GetLastMessageTimeStamp() int64
+	// sets message id if repo assigns it synchronously, onStored (may be nil) is called once repo durably accepted message
+	AddMessage(*message.Message, func(error)) error
+	GetNewerMessages(int, int64) ([]message.Message, error)
+	GetLastKMessages(int, int) ([]message.Message, error)
+	GetOlderMessages(int, int64, int) ([]message.Message, error)
 	CloseRepo() error
 }
+
+type BatchMode string
+
+const (
+	BatchSingle BatchMode = "single" // every message is inserted on its own
+	BatchInsert BatchMode = "insert" // multi-row insert
+	BatchCopy   BatchMode = "copy"   // copy protocol
+)
+
+// BatchRepository stores many messages at once, message ids are set in place
+type BatchRepository interface {
+	AddMessages([]message.Message, BatchMode) error
+}
+
+// Notifier pushes messages as soon as they are stored
+type Notifier interface {
+	Notifications() <-chan message.Message // nil if repo can't push messages, channel is closed once it stops
+}
+
+// Presence is shared by all server instances, so users connected to different instances see each other
+type Presence interface {
+	Join(cId int, uId int) error
+	Leave(cId int, uId int) error
+	Refresh(cId int, uIds []int) error // must be called more often than presence ttl not to lose users
+	CountOnline(cId int) (int, error)
+	ClosePresence() error
+}
+
+// Accounts checks user credentials, registered users are stored by repo
+type Accounts interface {
+	Register(name string, password string) (account.User, error)
+	Login(name string, password string) (account.User, error)
+}
+
+// UserRepository keeps registered users with their password hashes
+type UserRepository interface {
+	AddUser(name string, pHash []byte) (account.User, error)
+	GetUser(name string) (account.User, []byte, error)
+}
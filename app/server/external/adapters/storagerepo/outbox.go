@@ -0,0 +1,121 @@
+package storagerepo
+
+import (
+	"time"
+
+	"storage/external/event"
+
+	"go.uber.org/zap"
+)
+
+const RetryInterval = time.Second
+const MaxRetryDelay = 30 * time.Second
+const DrainTimeout = 10 * time.Second
+
+// delivery is kept for every message in outbox till kafka confirms it
+type delivery struct {
+	payload  []byte
+	onStored func(error) // nil for messages restored from outbox after restart
+	inFlight bool
+	attempts int
+	nextTry  time.Time
+}
+
+func retryDelay(attempts int) time.Duration {
+	return min(RetryInterval<<min(attempts, 16), MaxRetryDelay)
+}
+
+// messages left in outbox by previous run are sent again, their senders are gone, so nobody is acked
+func (sr *StorageRepo) restoreDeliveries() {
+	sr.dMu.Lock()
+	defer sr.dMu.Unlock()
+	for _, en := range sr.outbox.Pending() {
+		sr.deliveries[en.Seq] = &delivery{payload: en.Payload}
+	}
+	if len(sr.deliveries) != 0 {
+		sr.lg.Info("Restored undelivered messages from outbox", zap.Int("amount", len(sr.deliveries)))
+	}
+}
+
+// must be called with dMu held
+func (sr *StorageRepo) send(seq uint64, payload []byte) {
+	if sr.closed {
+		return
+	}
+	sr.sends.Add(1)
+	go func() {
+		defer sr.sends.Done()
+		sr.producer.WriteMessage(payload, sr.delivered(seq), event.Headers()...)
+	}()
+}
+
+// failed message stays in outbox and waits for retry, sender is acked only once
+func (sr *StorageRepo) delivered(seq uint64) func(error) {
+	return func(err error) {
+		sr.dMu.Lock()
+		d, ok := sr.deliveries[seq]
+		if !ok {
+			sr.dMu.Unlock()
+			return
+		}
+		if err != nil {
+			d.inFlight = false
+			d.attempts++
+			d.nextTry = time.Now().Add(retryDelay(d.attempts))
+			attempts := d.attempts
+			sr.dMu.Unlock()
+			sr.lg.Warn("Failed to deliver message to kafka, retry later", zap.Error(err), zap.Uint64("outbox seq", seq), zap.Int("attempts", attempts))
+			return
+		}
+		delete(sr.deliveries, seq)
+		sr.dMu.Unlock()
+
+		if e := sr.outbox.Ack(seq); e != nil {
+			sr.lg.Warn("Failed to ack message in outbox, it will be sent again after restart", zap.Error(e), zap.Uint64("outbox seq", seq))
+		}
+		if d.onStored != nil {
+			d.onStored(nil)
+		}
+	}
+}
+
+func (sr *StorageRepo) retryDeliveries() {
+	defer close(sr.retried)
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		sr.dMu.Lock()
+		for seq, d := range sr.deliveries {
+			if d.inFlight || now.Before(d.nextTry) {
+				continue
+			}
+			d.inFlight = true
+			sr.send(seq, d.payload)
+		}
+		sr.dMu.Unlock()
+	}
+}
+
+// waits for outbox to be delivered, whatever is left is sent after restart
+func (sr *StorageRepo) drainOutbox() {
+	deadline := time.NewTimer(DrainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for sr.outbox.Len() != 0 {
+		select {
+		case <-deadline.C:
+			sr.lg.Warn("Outbox is not drained, left messages are kept till restart", zap.Int("amount", sr.outbox.Len()))
+			return
+		case <-ticker.C:
+		}
+	}
+	sr.lg.Info("Outbox is drained")
+}
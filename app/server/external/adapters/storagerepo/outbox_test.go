@@ -0,0 +1,125 @@
+package storagerepo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"server/external/message"
+	"server/external/outbox"
+	"storage/external/event"
+	"storage/external/producer"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+)
+
+// kafka which takes records only after release, so a send stays in flight till then,
+// input is closed on close like sarama does
+type fakeKafka struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	release   chan struct{}
+}
+
+func newFakeKafka() *fakeKafka {
+	fk := &fakeKafka{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage, 16),
+		errors:    make(chan *sarama.ProducerError, 16),
+		release:   make(chan struct{}),
+	}
+	go func() {
+		<-fk.release
+		for msg := range fk.input {
+			fk.successes <- msg
+		}
+		close(fk.successes)
+		close(fk.errors)
+	}()
+	return fk
+}
+
+func (fk *fakeKafka) Input() chan<- *sarama.ProducerMessage     { return fk.input }
+func (fk *fakeKafka) Successes() <-chan *sarama.ProducerMessage { return fk.successes }
+func (fk *fakeKafka) Errors() <-chan *sarama.ProducerError      { return fk.errors }
+func (fk *fakeKafka) AsyncClose()                               { close(fk.input) }
+
+func newTestRepo(t *testing.T, ctx context.Context, fk *fakeKafka) *StorageRepo {
+	ob, err := outbox.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := zap.NewNop()
+	return newRepo(ctx, "", producer.NewFromAsync(ctx, fk, lg, event.AddedTopic), nil, ob, lg)
+}
+
+func addTestMessage(t *testing.T, sr *StorageRepo) <-chan error {
+	stored := make(chan error, 1)
+	msg := message.Message{User: "tester", Text: "hello"}
+	if err := sr.AddMessage(&msg, func(err error) { stored <- err }); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestCloseWaitsForSendInFlight(t *testing.T) {
+	fk := newFakeKafka()
+	sr := newTestRepo(t, context.Background(), fk)
+	stored := addTestMessage(t, sr)
+
+	closed := make(chan error, 1)
+	go func() { closed <- sr.CloseRepo() }()
+	select {
+	case <-closed:
+		t.Fatal("repo is closed while its message is in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(fk.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("repo is not closed after message is delivered")
+	}
+	if err := <-stored; err != nil {
+		t.Errorf("sender got %v, want nil", err)
+	}
+	if sr.outbox.Len() != 0 {
+		t.Errorf("outbox keeps %d delivered messages", sr.outbox.Len())
+	}
+
+	msg := message.Message{User: "tester", Text: "late"}
+	if err := sr.AddMessage(&msg, func(error) {}); err == nil {
+		t.Error("closed repo accepted a message")
+	}
+}
+
+func TestProducerClosedUnderSendInFlight(t *testing.T) {
+	fk := newFakeKafka()
+	ctx, cncl := context.WithCancel(context.Background())
+	sr := newTestRepo(t, ctx, fk)
+	stored := addTestMessage(t, sr)
+	time.Sleep(100 * time.Millisecond) // send gets blocked on producer input
+
+	cncl() // producer is closed by ctx under the send
+	time.Sleep(100 * time.Millisecond)
+	close(fk.release)
+
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Errorf("sender got %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send in flight is not reported")
+	}
+	if err := sr.CloseRepo(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,142 +6,222 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"server/external/message"
+	"server/external/outbox"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	storage_response "storage/external/api_response"
+	"storage/external/event"
 	"storage/external/producer"
+	"storage/external/subscriber"
 
 	"go.uber.org/zap"
 )
 
 type StorageRepo struct {
-	sAddr    string
-	producer *producer.Producer
-	lg       *zap.Logger
-	lMsgTmSt int64
+	sAddr      *atomic.Value // string, replaced by SetStorageAddr
+	producer   *producer.Producer
+	subscriber *subscriber.Subscriber
+	outbox     *outbox.Outbox // keeps messages till kafka confirms them
+	deliveries map[uint64]*delivery
+	dMu        *sync.Mutex
+	closed     bool            // guarded by dMu, nothing is sent after it
+	sends      *sync.WaitGroup // sends which may still write to producer
+	ctx        context.Context // retries stop once it is done
+	stop       context.CancelFunc
+	retried    chan struct{} // closed once retries stop
+	lg         *zap.Logger
 }
 
+const NotificationsGroupPrefix = "server-"
+
 var ErrorFailedMsgRequest error = errors.New("got non ok status code from server")
+var ErrorEmptyStorageAddr error = errors.New("storage address is empty")
+var ErrorRepoClosed error = errors.New("storage repo is closed, message is sent after restart")
 
 func NewRepo(ctx context.Context, rAddr map[string]string, lg *zap.Logger) *StorageRepo {
-	producer, err := producer.NewProducer(ctx, rAddr["kafkaAddr"], lg, "chat.messages.add")
+	producer, err := producer.NewProducer(ctx, rAddr["kafkaAddr"], lg, event.AddedTopic)
 	if err != nil {
 		lg.Fatal("Failed to connect to storage")
 	}
-	return &StorageRepo{sAddr: rAddr["storageAddr"], producer: producer, lg: lg, lMsgTmSt: -1}
-}
 
-func (sr *StorageRepo) GetNewerMessages() ([]message.Message, error) {
-	client := http.Client{}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/get", sr.sAddr), http.NoBody)
+	// every server instance has its own consumer group, so each one reads all partitions and delivers message once to its own clients
+	subscriber, err := subscriber.NewSubscriber(ctx, rAddr["kafkaAddr"], NotificationsGroupPrefix+rAddr["instance"], lg, event.PersistedTopic)
 	if err != nil {
-		return nil, err
+		lg.Warn("Failed to subscribe to persisted messages, only polling will be used", zap.Error(err))
 	}
 
-	queries := req.URL.Query()
-	queries.Set("last_message_time_stamp", fmt.Sprint(sr.GetLastMessageTimeStamp()))
-	queries.Set("conference_id", "0")
-	req.URL.RawQuery = queries.Encode()
-
-	resp, err := client.Do(req)
+	obDir := filepath.Join(rAddr["outboxDir"], rAddr["instance"])
+	ob, err := outbox.Open(obDir)
 	if err != nil {
-		sr.lg.Error("Storage response failed", zap.Error(err))
-		return nil, err
+		lg.Fatal("Failed to open outbox", zap.Error(err), zap.String("outbox dir", obDir))
 	}
-	if resp.StatusCode != http.StatusOK {
-		sr.lg.Error("Storage response failed", zap.Int("Status code", resp.StatusCode))
-		return nil, ErrorFailedMsgRequest
+	// recreated containers get new names, so outboxes left by them are taken over by whoever starts next
+	if adopted, err := ob.Adopt(rAddr["outboxDir"]); err != nil {
+		lg.Warn("Failed to adopt outboxes of stopped instances", zap.Error(err), zap.Int("adopted", adopted))
+	} else if adopted != 0 {
+		lg.Info("Adopted messages from outboxes of stopped instances", zap.Int("amount", adopted))
 	}
 
-	buf := make([]byte, 1e5) // bad const change !!!
-	n, err := resp.Body.Read(buf)
-	if err != nil && err != io.EOF {
-		sr.lg.Error("New messages failed to read response buffer", zap.Error(err))
-		return nil, err
-	}
+	return newRepo(ctx, rAddr["storageAddr"], producer, subscriber, ob, lg)
+}
 
-	respData, err := storage_response.DecodeResponseFromBytes(buf[:n])
-	if err != nil && err != io.EOF {
-		sr.lg.Error("New messages failed to decode response", zap.Error(err))
-		return nil, err
-	}
+// subscriber may be nil
+func newRepo(ctx context.Context, sAddr string, producer *producer.Producer, subscriber *subscriber.Subscriber, ob *outbox.Outbox, lg *zap.Logger) *StorageRepo {
+	ctx, stop := context.WithCancel(ctx)
+	sr := &StorageRepo{sAddr: &atomic.Value{}, producer: producer, subscriber: subscriber, outbox: ob, deliveries: make(map[uint64]*delivery), dMu: &sync.Mutex{}, sends: &sync.WaitGroup{}, ctx: ctx, stop: stop, retried: make(chan struct{}), lg: lg}
+	sr.sAddr.Store(sAddr)
+	sr.restoreDeliveries()
+	go sr.retryDeliveries()
+	return sr
+}
 
-	sr.lg.Debug("Successfully get new messages", zap.Int("Msgs amount", len(respData.GetMsgs())), zap.Int64("last message time stamp", respData.GetLastMessageTimeStamp()))
-	if lMsgTst := respData.GetLastMessageTimeStamp(); lMsgTst > sr.GetLastMessageTimeStamp() {
-		sr.SetLastMessageTimeStamp(lMsgTst)
+// requests started before keep the old address
+func (sr *StorageRepo) SetStorageAddr(addr string) error {
+	if addr == "" {
+		return ErrorEmptyStorageAddr
 	}
+	sr.sAddr.Store(addr)
+	sr.lg.Info("Storage address changed", zap.String("storage addr", addr))
+	return nil
+}
 
-	return respData.GetMsgs(), nil
+func (sr *StorageRepo) storageURL(path string) string {
+	return fmt.Sprintf("http://%s%s", sr.sAddr.Load().(string), path)
 }
 
-const GetLastMessagesQuery = `SELECT userid, username, text, timestamp FROM messages ORDER BY timestamp DESC LIMIT $1;`
+func (sr *StorageRepo) Notifications() <-chan message.Message {
+	if sr.subscriber == nil {
+		return nil
+	}
+	return sr.subscriber.Messages()
+}
 
-func (sr *StorageRepo) GetLastKMessages(k int) ([]message.Message, error) {
+// asks storage handler by path, empty response body is treated as response without messages
+func (sr *StorageRepo) requestMessages(path string, queries url.Values) (storage_response.StorageResponse, error) {
 	client := http.Client{}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/get_newbie", sr.sAddr), http.NoBody)
+	req, err := http.NewRequest(http.MethodGet, sr.storageURL(path), http.NoBody)
 	if err != nil {
-		sr.lg.Error("Failed to create request to get newbie messages", zap.Error(err))
-		return nil, err
+		sr.lg.Error("Failed to create request to storage", zap.Error(err), zap.String("path", path))
+		return storage_response.StorageResponse{}, err
 	}
-
-	queries := req.URL.Query()
-	queries.Set("conference_id", "0")
-	queries.Set("amount", strconv.Itoa(k))
 	req.URL.RawQuery = queries.Encode()
 
 	resp, err := client.Do(req)
 	if err != nil {
-		sr.lg.Error("Newbie messages request failed", zap.Error(err))
-		return nil, err
+		sr.lg.Error("Storage response failed", zap.Error(err), zap.String("path", path))
+		return storage_response.StorageResponse{}, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, ErrorFailedMsgRequest
+		sr.lg.Error("Storage response failed", zap.Int("Status code", resp.StatusCode), zap.String("path", path))
+		return storage_response.StorageResponse{}, ErrorFailedMsgRequest
 	}
 
-	buf := make([]byte, 1e5) // bad const change !!!
-	n, err := resp.Body.Read(buf)
-	if err != nil && err != io.EOF {
-		sr.lg.Error("Newbie messages failed to read body buffer", zap.Error(err))
-		return nil, err
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		sr.lg.Error("Failed to read storage response body", zap.Error(err), zap.String("path", path))
+		return storage_response.StorageResponse{}, err
 	}
 
-	if n == 0 {
-		return []message.Message{}, nil
+	if len(buf) == 0 {
+		return storage_response.NewResponse([]message.Message{}, -1), nil
 	}
 
-	respData, err := storage_response.DecodeResponseFromBytes(buf[:n])
+	respData, err := storage_response.DecodeResponseFromBytes(buf)
 	if err != nil {
-		sr.lg.Error("Newbie messages failed to decode response", zap.Error(err))
-		return nil, err
+		sr.lg.Error("Failed to decode storage response", zap.Error(err), zap.String("path", path))
+		return storage_response.StorageResponse{}, err
 	}
+	return respData, nil
+}
 
-	sr.lg.Debug("Successfully get newbie messages", zap.Int("Msgs amount", len(respData.GetMsgs())), zap.Int64("last message time stamp", respData.GetLastMessageTimeStamp()))
-	if lMsgTst := respData.GetLastMessageTimeStamp(); lMsgTst > sr.GetLastMessageTimeStamp() {
-		sr.SetLastMessageTimeStamp(lMsgTst)
+// returns one page of messages with id bigger than lMsgId
+func (sr *StorageRepo) GetNewerMessages(cId int, lMsgId int64) ([]message.Message, error) {
+	respData, err := sr.requestMessages("/get", url.Values{
+		"last_message_id": {strconv.FormatInt(lMsgId, 10)},
+		"conference_id":   {strconv.Itoa(cId)},
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	sr.lg.Debug("Successfully get new messages", zap.Int("chat id", cId), zap.Int("Msgs amount", len(respData.GetMsgs())), zap.Int64("last message id", respData.GetLastMessageId()))
 	return respData.GetMsgs(), nil
 }
-func (sr *StorageRepo) AddMessage(m message.Message) error {
-	sr.lg.Debug("Add new message", zap.Int("user id", m.GetUserId()), zap.Int("chat id", m.GetChatId()))
-	buf, err := message.EncodeMsgsToBytes(m)
+
+func (sr *StorageRepo) GetLastKMessages(cId int, k int) ([]message.Message, error) {
+	respData, err := sr.requestMessages("/get_newbie", url.Values{
+		"conference_id": {strconv.Itoa(cId)},
+		"amount":        {strconv.Itoa(k)},
+	})
 	if err != nil {
-		sr.lg.Error("Failed to encode message to bytes", zap.Error(err))
-		return err
+		return nil, err
 	}
-	go sr.producer.WriteMessage(buf)
-	return nil
-}
 
-func (sr *StorageRepo) SetLastMessageTimeStamp(lMsgTimeStamp int64) {
-	sr.lMsgTmSt = lMsgTimeStamp
+	sr.lg.Debug("Successfully get newbie messages", zap.Int("chat id", cId), zap.Int("Msgs amount", len(respData.GetMsgs())), zap.Int64("last message id", respData.GetLastMessageId()))
+	return respData.GetMsgs(), nil
 }
 
-func (sr *StorageRepo) GetLastMessageTimeStamp() int64 {
-	return sr.lMsgTmSt
+// returns k messages older than bMsgId from newer to older
+func (sr *StorageRepo) GetOlderMessages(cId int, bMsgId int64, k int) ([]message.Message, error) {
+	respData, err := sr.requestMessages("/get_history", url.Values{
+		"conference_id":     {strconv.Itoa(cId)},
+		"before_message_id": {strconv.FormatInt(bMsgId, 10)},
+		"amount":            {strconv.Itoa(k)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sr.lg.Debug("Successfully get history messages", zap.Int("chat id", cId), zap.Int("Msgs amount", len(respData.GetMsgs())), zap.Int64("before message id", bMsgId))
+	return respData.GetMsgs(), nil
 }
 
-func (pr *StorageRepo) CloseRepo() error {
+// message id is given later by storage service, so m stays without it,
+// message is written to outbox first and retried till kafka confirms it, then onStored is called
+func (sr *StorageRepo) AddMessage(m *message.Message, onStored func(error)) error {
+	sr.lg.Debug("Add new message", zap.Int("user id", m.GetUserId()), zap.Int("chat id", m.GetChatId()), zap.String("client id", m.GetClientId()))
+	if m.GetEventId() == "" {
+		m.SetEventId(event.NewEventId())
+	}
+	payload := event.EncodeMessage(*m)
+	seq, err := sr.outbox.Put(payload)
+	if err != nil {
+		sr.lg.Error("Failed to put message to outbox", zap.Error(err), zap.Int("user id", m.GetUserId()))
+		return err
+	}
+
+	sr.dMu.Lock()
+	if sr.closed {
+		sr.dMu.Unlock()
+		return ErrorRepoClosed
+	}
+	sr.deliveries[seq] = &delivery{payload: payload, onStored: onStored, inFlight: true}
+	sr.send(seq, payload)
+	sr.dMu.Unlock()
 	return nil
 }
+
+// failed deliveries are retried while outbox is drained, then sends in flight are awaited,
+// so producer isn't closed under them, and producer reports them before outbox is closed
+func (sr *StorageRepo) CloseRepo() error {
+	sr.drainOutbox()
+	sr.stop()
+	<-sr.retried
+
+	sr.dMu.Lock()
+	sr.closed = true
+	sr.dMu.Unlock()
+	sr.sends.Wait()
+
+	sr.producer.Close()
+	if sr.subscriber != nil {
+		sr.subscriber.Close()
+	}
+	return sr.outbox.Close()
+}
@@ -0,0 +1,54 @@
+package storagerepo
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"server/external/account"
+
+	storage_response "storage/external/api_response"
+
+	"go.uber.org/zap"
+)
+
+// passwords are checked by storage, server only gets user back
+func (sr *StorageRepo) requestUser(path string, name string, password string) (account.User, error) {
+	resp, err := http.PostForm(sr.storageURL(path), url.Values{"name": {name}, "password": {password}})
+	if err != nil {
+		sr.lg.Error("Storage response failed", zap.Error(err), zap.String("path", path))
+		return account.User{}, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		sr.lg.Error("Failed to read storage response body", zap.Error(err), zap.String("path", path))
+		return account.User{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return account.User{}, account.ErrorUserExists
+	case http.StatusUnauthorized:
+		return account.User{}, account.ErrorWrongCredentials
+	default:
+		sr.lg.Error("Storage response failed", zap.Int("Status code", resp.StatusCode), zap.String("path", path))
+		return account.User{}, ErrorFailedMsgRequest
+	}
+
+	respData, err := storage_response.DecodeUserResponseFromBytes(buf)
+	if err != nil {
+		sr.lg.Error("Failed to decode storage response", zap.Error(err), zap.String("path", path))
+		return account.User{}, err
+	}
+	return respData.GetUser(), nil
+}
+
+func (sr *StorageRepo) Register(name string, password string) (account.User, error) {
+	return sr.requestUser("/register", name, password)
+}
+
+func (sr *StorageRepo) Login(name string, password string) (account.User, error) {
+	return sr.requestUser("/login", name, password)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"server/external/account"
+	"strings"
+	"time"
+)
+
+const TokenTTL = 24 * time.Hour
+
+var ErrorInvalidToken error = errors.New("token is malformed or has wrong signature")
+var ErrorExpiredToken error = errors.New("token is expired")
+var ErrorEmptySecret error = errors.New("token secret must not be empty")
+
+type claims struct {
+	UId  int    `json:"uid"`
+	Name string `json:"name"`
+	Exp  int64  `json:"exp"` // unix seconds
+}
+
+// Issuer signs tokens with hmac sha256, so every instance sharing the secret accepts them
+type Issuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewIssuer(secret string, ttl time.Duration) (*Issuer, error) {
+	if secret == "" {
+		return nil, ErrorEmptySecret
+	}
+	return &Issuer{secret: []byte(secret), ttl: ttl}, nil
+}
+
+func (i *Issuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token is base64 json claims and their signature separated by dot
+func (i *Issuer) Issue(u account.User) (string, error) {
+	buf, e := json.Marshal(claims{UId: u.Id, Name: u.Name, Exp: time.Now().Add(i.ttl).Unix()})
+	if e != nil {
+		return "", e
+	}
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	return payload + "." + i.sign(payload), nil
+}
+
+func (i *Issuer) Verify(token string) (account.User, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(i.sign(payload))) {
+		return account.User{}, ErrorInvalidToken
+	}
+
+	buf, e := base64.RawURLEncoding.DecodeString(payload)
+	if e != nil {
+		return account.User{}, ErrorInvalidToken
+	}
+	var c claims
+	if e = json.Unmarshal(buf, &c); e != nil {
+		return account.User{}, ErrorInvalidToken
+	}
+	if time.Now().Unix() >= c.Exp {
+		return account.User{}, ErrorExpiredToken
+	}
+	return account.NewUser(c.UId, c.Name), nil
+}
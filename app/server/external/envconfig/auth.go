@@ -0,0 +1,237 @@
+package envconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+type AuthMethod string
+
+const (
+	AuthToken     AuthMethod = "token"      // vaultToken or VAULT_TOKEN
+	AuthTokenFile AuthMethod = "token-file" // token written by vault agent or an operator, read again when it expires
+	AuthAppRole   AuthMethod = "approle"    // role and secret ids, service logs in again when its token expires
+)
+
+const DefaultAppRoleMount = "approle"
+
+// token is renewed when a third of its ttl is left, failed renewals are retried after RenewRetryDelay,
+// renewed token with ttl below MinTokenTTL is replaced by logging in again
+const (
+	RenewRetryDelay = 5 * time.Second
+	MinTokenTTL     = 10 * time.Second
+)
+
+var ErrorUnknownAuth error = errors.New("unknown vault auth method, expected token, token-file or approle")
+var ErrorNoCredentials error = errors.New("vault credentials are missing")
+var ErrorTokenExpired error = errors.New("vault token can't be renewed and there is no way to get a new one")
+var ErrorNoAuth error = errors.New("vault returned no auth")
+
+func ParseAuthMethod(s string) (AuthMethod, error) {
+	switch m := AuthMethod(s); m {
+	case AuthToken, AuthTokenFile, AuthAppRole:
+		return m, nil
+	}
+	return "", ErrorUnknownAuth
+}
+
+// method is inferred from given credentials if it isn't set
+func (v Vault) authMethod() (AuthMethod, error) {
+	switch {
+	case v.VaultAuth != "":
+		return ParseAuthMethod(v.VaultAuth)
+	case v.VaultRoleId != "" || v.VaultRoleIdFile != "":
+		return AuthAppRole, nil
+	case v.VaultTokenFile != "":
+		return AuthTokenFile, nil
+	}
+	return AuthToken, nil
+}
+
+// tokenAuth logs vault client in and keeps its token alive, it is used by one goroutine at a time
+type tokenAuth struct {
+	c         *vault.Client
+	cfg       Vault
+	method    AuthMethod
+	ttl       time.Duration // 0 for tokens which never expire
+	renewable bool
+}
+
+func newTokenAuth(c *vault.Client, cfg Vault) (*tokenAuth, error) {
+	method, err := cfg.authMethod()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.VaultAppRoleMount == "" {
+		cfg.VaultAppRoleMount = DefaultAppRoleMount
+	}
+	return &tokenAuth{c: c, cfg: cfg, method: method}, nil
+}
+
+// value is read from file if it isn't given
+func readCredential(value string, file string) (string, error) {
+	if value != "" || file == "" {
+		return value, nil
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func (ta *tokenAuth) login(ctx context.Context) error {
+	switch ta.method {
+	case AuthToken, AuthTokenFile:
+		token, err := readCredential(ta.cfg.VaultToken, ta.cfg.VaultTokenFile)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			ta.c.SetToken(token)
+		}
+		if ta.c.Token() == "" {
+			return ErrorNoCredentials
+		}
+		return ta.lookup(ctx)
+	}
+
+	roleId, err := readCredential(ta.cfg.VaultRoleId, ta.cfg.VaultRoleIdFile)
+	if err != nil {
+		return err
+	}
+	secretId, err := readCredential(ta.cfg.VaultSecretId, ta.cfg.VaultSecretIdFile)
+	if err != nil {
+		return err
+	}
+	if roleId == "" {
+		return ErrorNoCredentials
+	}
+	secret, err := ta.c.Logical().WriteWithContext(ctx, "auth/"+ta.cfg.VaultAppRoleMount+"/login", map[string]any{"role_id": roleId, "secret_id": secretId})
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return ErrorNoAuth
+	}
+	ta.c.SetToken(secret.Auth.ClientToken)
+	ta.ttl, ta.renewable = time.Duration(secret.Auth.LeaseDuration)*time.Second, secret.Auth.Renewable
+	return nil
+}
+
+// token of other methods is not issued by login, so its ttl is asked
+func (ta *tokenAuth) lookup(ctx context.Context) error {
+	secret, err := ta.c.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if ta.ttl, err = secret.TokenTTL(); err != nil {
+		return err
+	}
+	ta.renewable, err = secret.TokenIsRenewable()
+	return err
+}
+
+// renews token, logs in again if it can't be renewed anymore
+func (ta *tokenAuth) refresh(ctx context.Context) error {
+	var renewErr error
+	if ta.renewable {
+		secret, err := ta.c.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err == nil && secret != nil && secret.Auth != nil {
+			ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+			if ttl >= MinTokenTTL {
+				ta.ttl, ta.renewable = ttl, secret.Auth.Renewable
+				return nil
+			}
+		}
+		renewErr = err
+	}
+	if ta.method == AuthToken {
+		return errors.Join(ErrorTokenExpired, renewErr)
+	}
+	if err := ta.login(ctx); err != nil {
+		return errors.Join(fmt.Errorf("vault %s login: %w", ta.method, err), renewErr)
+	}
+	return nil
+}
+
+// refreshes token before it expires till ctx is done or token stops expiring
+func (ta *tokenAuth) keep(ctx context.Context, onError func(err error)) {
+	wait := ta.ttl * 2 / 3
+	for ta.ttl > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		rctx, cncl := context.WithTimeout(ctx, VaultTimeout)
+		err := ta.refresh(rctx)
+		cncl()
+		if err != nil {
+			onError(err)
+			wait = RenewRetryDelay
+			continue
+		}
+		wait = ta.ttl * 2 / 3
+	}
+}
+
+type RoleCredentials struct {
+	RoleId   string
+	SecretId string
+}
+
+// writes policy of every service and creates approle role with it, approle auth is enabled on authMount if needed.
+// every call issues new secret ids, the old ones stay valid
+func (es EnvStorage) SetupAppRoles(ctx context.Context, authMount string, tokenTTL time.Duration, tokenMaxTTL time.Duration) (map[string]RoleCredentials, error) {
+	mounts, err := es.c.Sys().ListAuthWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := mounts[authMount+"/"]; !ok {
+		if err = es.c.Sys().EnableAuthWithOptionsWithContext(ctx, authMount, &vault.EnableAuthOptions{Type: string(AuthAppRole)}); err != nil {
+			return nil, err
+		}
+	}
+
+	policies, err := Policies(es.mount)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(map[string]RoleCredentials, len(policies))
+	for name, rules := range policies {
+		if err = es.c.Sys().PutPolicyWithContext(ctx, name, rules); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+		role := "auth/" + authMount + "/role/" + name
+		_, err = es.c.Logical().WriteWithContext(ctx, role, map[string]any{
+			"token_policies": name,
+			"token_ttl":      int(tokenTTL.Seconds()),
+			"token_max_ttl":  int(tokenMaxTTL.Seconds()),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", name, err)
+		}
+
+		roleId, err := es.c.Logical().ReadWithContext(ctx, role+"/role-id")
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", name, err)
+		}
+		secretId, err := es.c.Logical().WriteWithContext(ctx, role+"/secret-id", nil)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", name, err)
+		}
+		if roleId == nil || secretId == nil {
+			return nil, fmt.Errorf("%w: role %s", ErrorNoAuth, name)
+		}
+		creds[name] = RoleCredentials{RoleId: fmt.Sprint(roleId.Data["role_id"]), SecretId: fmt.Sprint(secretId.Data["secret_id"])}
+	}
+	return creds, nil
+}
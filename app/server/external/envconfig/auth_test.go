@@ -0,0 +1,161 @@
+package envconfig
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"envconfig/vaultfake"
+)
+
+func newFakeVault(t *testing.T) (*vaultfake.Server, string) {
+	t.Setenv("VAULT_TOKEN", "") // vault client takes it by default
+	fake := vaultfake.New()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv.URL
+}
+
+func writeFile(t *testing.T, name string, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func refresh(t *testing.T, es EnvStorage) error {
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	return es.auth.refresh(ctx)
+}
+
+func TestAppRoleLogin(t *testing.T) {
+	fake, addr := newFakeVault(t)
+	roleId, secretId := fake.AddRole("server", []string{"server"}, time.Hour, 24*time.Hour)
+
+	es, err := NewVaultStorage(Vault{VaultAddr: addr, VaultRoleId: roleId, VaultSecretId: secretId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.auth.method != AuthAppRole || es.auth.ttl != time.Hour || !es.auth.renewable {
+		t.Fatalf("got %s auth with ttl %v and renewable %v, want approle one with ttl 1h and renewable", es.auth.method, es.auth.ttl, es.auth.renewable)
+	}
+	if es.c.Token() == fake.RootToken || es.c.Token() == "" {
+		t.Fatalf("storage doesn't use token got by login")
+	}
+	if err = es.EnvUpdateAddr("kafkaAddr", "kafka:9092"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := es.EnvGetAddr("kafkaAddr"); err != nil || addr != "kafka:9092" {
+		t.Fatalf("got %q, %v, want kafka:9092", addr, err)
+	}
+
+	if _, err = NewVaultStorage(Vault{VaultAddr: addr, VaultRoleId: roleId, VaultSecretId: "wrong"}); err == nil {
+		t.Fatal("login with wrong secret id succeeded")
+	}
+}
+
+func TestAppRoleCredentialsFromFiles(t *testing.T) {
+	fake, addr := newFakeVault(t)
+	roleId, secretId := fake.AddRole("storage", []string{"storage"}, time.Hour, 24*time.Hour)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "role_id"), roleId+"\n")
+	writeFile(t, filepath.Join(dir, "secret_id"), secretId+"\n")
+
+	_, err := NewVaultStorage(Vault{VaultAddr: addr, VaultRoleIdFile: filepath.Join(dir, "role_id"), VaultSecretIdFile: filepath.Join(dir, "secret_id")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenFileIsReadAgain(t *testing.T) {
+	fake, addr := newFakeVault(t)
+	file := filepath.Join(t.TempDir(), "token")
+	first := fake.IssueToken(time.Hour, 0, false)
+	writeFile(t, file, first)
+
+	es, err := NewVaultStorage(Vault{VaultAddr: addr, VaultTokenFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.auth.method != AuthTokenFile || es.c.Token() != first {
+		t.Fatalf("got %s auth, want token-file one with token from file", es.auth.method)
+	}
+
+	// token can't be renewed, so file written by an operator or vault agent is read again
+	second := fake.IssueToken(time.Hour, 0, false)
+	writeFile(t, file, second)
+	if err = refresh(t, es); err != nil {
+		t.Fatal(err)
+	}
+	if es.c.Token() != second {
+		t.Fatal("token was not read from file again")
+	}
+	if _, _, _, err = es.LookupVersion("kafkaAddr"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshRenewsOrLogsInAgain(t *testing.T) {
+	fake, addr := newFakeVault(t)
+
+	long, longSecret := fake.AddRole("long", []string{"long"}, time.Minute, time.Hour)
+	es, err := NewVaultStorage(Vault{VaultAddr: addr, VaultRoleId: long, VaultSecretId: longSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := es.c.Token()
+	if err = refresh(t, es); err != nil {
+		t.Fatal(err)
+	}
+	if es.c.Token() != token || es.auth.ttl < MinTokenTTL {
+		t.Fatalf("token with ttl %v far from max ttl was not renewed", es.auth.ttl)
+	}
+
+	// renewal is capped by max ttl, so token which would live less than MinTokenTTL is replaced by a new one
+	short, shortSecret := fake.AddRole("short", []string{"short"}, MinTokenTTL/2, MinTokenTTL-time.Second)
+	es, err = NewVaultStorage(Vault{VaultAddr: addr, VaultRoleId: short, VaultSecretId: shortSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = es.c.Token()
+	if err = refresh(t, es); err != nil {
+		t.Fatal(err)
+	}
+	if es.c.Token() == token {
+		t.Fatal("token close to its max ttl was renewed instead of logging in again")
+	}
+
+	// plain token has no way to get a new one
+	es, err = NewVaultStorage(Vault{VaultAddr: addr, VaultToken: fake.IssueToken(time.Hour, 0, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = refresh(t, es); !errors.Is(err, ErrorTokenExpired) {
+		t.Fatalf("got %v, want %v", err, ErrorTokenExpired)
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+	_, addr := newFakeVault(t)
+	for _, cfg := range []Vault{
+		{VaultAddr: addr},
+		{VaultAddr: addr, VaultAuth: string(AuthTokenFile)},
+		{VaultAddr: addr, VaultAuth: string(AuthAppRole)},
+	} {
+		if _, err := NewVaultStorage(cfg); !errors.Is(err, ErrorNoCredentials) {
+			t.Fatalf("%s auth: got %v, want %v", cfg.VaultAuth, err, ErrorNoCredentials)
+		}
+	}
+
+	if _, err := NewVaultStorage(Vault{VaultAddr: addr, VaultTokenFile: filepath.Join(t.TempDir(), "absent")}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v for absent token file, want %v", err, os.ErrNotExist)
+	}
+	if _, err := NewVaultStorage(Vault{VaultAddr: addr, VaultAuth: "kerberos"}); !errors.Is(err, ErrorUnknownAuth) {
+		t.Fatalf("got %v, want %v", err, ErrorUnknownAuth)
+	}
+}
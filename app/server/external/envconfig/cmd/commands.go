@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"envconfig"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const DefaultManifest = "vault.yaml"
+
+func runSeed(es envconfig.EnvStorage, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	file := fs.String("f", DefaultManifest, "manifest with secrets to write")
+	wait := fs.Duration("wait", 0, "how long to wait for vault to become ready, 0 means not to wait")
+	fs.Parse(args)
+
+	m, err := envconfig.ReadManifest(*file)
+	if err != nil {
+		return err
+	}
+	if err = waitLogin(es, *wait); err != nil {
+		return err
+	}
+
+	written := 0
+	for _, name := range m.Names() {
+		changed, err := es.Update(name, m[name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if changed {
+			written++
+			fmt.Printf("written %s\n", name)
+		}
+	}
+	fmt.Printf("%d of %d secrets written, the rest are up to date\n", written, len(m))
+	return nil
+}
+
+// waits for vault to become ready and logs in, credentials written by whoever initializes vault
+// may appear a bit later, so login is retried till wait is over
+func waitLogin(es envconfig.EnvStorage, wait time.Duration) error {
+	ctx, cncl := context.WithTimeout(context.Background(), max(wait, envconfig.VaultTimeout))
+	defer cncl()
+	if wait > 0 {
+		if err := es.Ready(ctx); err != nil {
+			return err
+		}
+	}
+	for {
+		err := es.Login(ctx)
+		if err == nil || wait <= 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func runGet(es envconfig.EnvStorage, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("%w: usage: get name [field]", ErrorBadArgs)
+	}
+	field := envconfig.AddrField
+	if len(args) == 2 {
+		field = args[1]
+	}
+
+	values, ok, err := es.Get(args[0])
+	if err != nil {
+		return err
+	}
+	v, hasField := values[field]
+	if !ok || !hasField {
+		return fmt.Errorf("%s.%s is not set", args[0], field)
+	}
+	fmt.Println(v)
+	return nil
+}
+
+func runSet(es envconfig.EnvStorage, args []string) error {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	field := fs.String("field", envconfig.AddrField, "field of secret to set")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("%w: usage: set [-field f] name value", ErrorBadArgs)
+	}
+
+	changed, err := es.Update(fs.Arg(0), map[string]string{*field: fs.Arg(1)})
+	if err != nil {
+		return err
+	}
+	if !changed {
+		fmt.Printf("%s.%s is up to date\n", fs.Arg(0), *field)
+	}
+	return nil
+}
+
+// returns true if vault differs from manifest, values are not printed unless asked as they may be secrets
+func runDiff(es envconfig.EnvStorage, args []string) (bool, error) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	file := fs.String("f", DefaultManifest, "manifest to compare vault with")
+	showValues := fs.Bool("values", false, "print values, not only names of differing fields")
+	fs.Parse(args)
+
+	m, err := envconfig.ReadManifest(*file)
+	if err != nil {
+		return false, err
+	}
+	show := func(v string) string {
+		if *showValues {
+			return " " + v
+		}
+		return ""
+	}
+
+	differs := false
+	for _, name := range m.Names() {
+		cur, ok, err := es.Get(name)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+		if !ok {
+			fmt.Printf("+ %s\n", name)
+			differs = true
+			continue
+		}
+		for _, field := range sortedFields(m[name], cur) {
+			want, inManifest := m[name][field]
+			have, inVault := cur[field]
+			switch {
+			case !inVault:
+				fmt.Printf("+ %s.%s%s\n", name, field, show(want))
+			case !inManifest: // seed keeps such fields, so they don't count as difference
+				fmt.Printf("  %s.%s only in vault%s\n", name, field, show(have))
+				continue
+			case want != have:
+				fmt.Printf("~ %s.%s%s\n", name, field, show(have+" -> "+want))
+			default:
+				continue
+			}
+			differs = true
+		}
+	}
+
+	names, err := es.List()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if _, ok := m[name]; !ok {
+			fmt.Printf("  %s only in vault\n", name)
+		}
+	}
+	return differs, nil
+}
+
+func sortedFields(a, b map[string]string) []string {
+	fields := make([]string, 0, len(a)+len(b))
+	for field := range a {
+		fields = append(fields, field)
+	}
+	for field := range b {
+		if _, ok := a[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func runExport(es envconfig.EnvStorage, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "file to write manifest to, stdout is used if empty, mind that it has secrets in plain text")
+	fs.Parse(args)
+
+	names, err := es.List()
+	if err != nil {
+		return err
+	}
+	m := make(envconfig.Manifest, len(names))
+	for _, name := range names {
+		values, ok, err := es.Get(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if ok { // deleted secrets are still listed
+			m[name] = values
+		}
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return m.Encode(w)
+}
+
+// role and secret ids are written to out/<service>/role_id and secret_id, services read them with vaultRoleIdFile and vaultSecretIdFile
+func runAppRole(es envconfig.EnvStorage, args []string) error {
+	fs := flag.NewFlagSet("approle", flag.ExitOnError)
+	mount := fs.String("mount", envconfig.DefaultAppRoleMount, "mount of approle auth method")
+	out := fs.String("out", "vault-auth", "directory to write role and secret ids of services to")
+	ttl := fs.Duration("token-ttl", time.Hour, "ttl of tokens services get by logging in, they are renewed while it is not reached")
+	maxTTL := fs.Duration("token-max-ttl", 24*time.Hour, "ttl after which services have to log in again")
+	fs.Parse(args)
+
+	ctx, cncl := context.WithTimeout(context.Background(), time.Minute)
+	defer cncl()
+	creds, err := es.SetupAppRoles(ctx, *mount, *ttl, *maxTTL)
+	if err != nil {
+		return err
+	}
+	for name, c := range creds {
+		dir := filepath.Join(*out, name)
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dir, "role_id"), []byte(c.RoleId), 0600); err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dir, "secret_id"), []byte(c.SecretId), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("role %s is written to %s\n", name, dir)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// fakevault serves envconfig/vaultfake, so services and envconfig can be run without vault.
+//
+//	fakevault [-addr 127.0.0.1:8200]
+//
+// Root token is printed on start, secrets live only in memory.
+package main
+
+import (
+	"envconfig/vaultfake"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8200", "address to listen on")
+	flag.Parse()
+
+	s := vaultfake.New()
+	fmt.Printf("listening on %s, root token %s\n", *addr, s.RootToken)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,96 @@
+// envconfig keeps service addresses and secrets in vault kv v2 secrets engine.
+//
+//	envconfig [vault flags] seed [-f manifest] [-wait d]   writes secrets of manifest which differ from vault
+//	envconfig [vault flags] get name [field]                prints field of secret, addr by default
+//	envconfig [vault flags] set [-field f] name value       sets field of secret keeping the other ones
+//	envconfig [vault flags] diff [-f manifest] [-values]    shows how vault differs from manifest, exits with 1 if it does
+//	envconfig [vault flags] export [-o file]                writes every secret of the mount as manifest
+//	envconfig [vault flags] approle [-out dir]              writes policies of services and their approle credentials
+//
+// Vault is configured like services do, by -vault-addr, -vault-token, -vault-mount and other flags, CHAT_VAULT_ADDR,
+// CHAT_VAULT_TOKEN, CHAT_VAULT_MOUNT and other variables or -config file.
+package main
+
+import (
+	"context"
+	"envconfig"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const usage = `usage: envconfig [vault flags] seed | get | set | diff | export | approle, run "envconfig <command> -h" for command flags`
+
+var ErrorNoVaultAddr error = errors.New("vaultAddr is required")
+var ErrorBadArgs error = errors.New("bad arguments")
+
+type Config struct {
+	envconfig.Vault
+}
+
+func (cfg Config) Validate() error {
+	if cfg.VaultAddr == "" {
+		return ErrorNoVaultAddr
+	}
+	return nil
+}
+
+func main() {
+	cfg := Config{envconfig.Vault{VaultAddr: "http://localhost:8200", VaultMount: envconfig.DefaultVaultMount}}
+	ld, err := envconfig.NewLoader(flag.CommandLine, &cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.Usage = func() { fmt.Fprintln(flag.CommandLine.Output(), usage); flag.PrintDefaults() }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err = ld.Load(); err != nil {
+		log.Fatal(err)
+	}
+	es, err := envconfig.OpenVaultStorage(cfg.Vault)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	if cmd != "seed" { // seed may wait for vault to become ready first
+		ctx, cncl := context.WithTimeout(context.Background(), envconfig.VaultTimeout)
+		err = es.Login(ctx)
+		cncl()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch cmd {
+	case "seed":
+		err = runSeed(es, args)
+	case "get":
+		err = runGet(es, args)
+	case "set":
+		err = runSet(es, args)
+	case "diff":
+		var differs bool
+		if differs, err = runDiff(es, args); err == nil && differs {
+			os.Exit(1)
+		}
+	case "export":
+		err = runExport(es, args)
+	case "approle":
+		err = runAppRole(es, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if errors.Is(err, ErrorBadArgs) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+}
@@ -0,0 +1,411 @@
+package envconfig
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// environment variables are named by config keys, e.g. kafkaAddr is read from CHAT_KAFKA_ADDR
+const EnvPrefix = "CHAT_"
+
+// config file is given by -config flag or by this variable
+const ConfigFileEnv = EnvPrefix + "CONFIG"
+
+var ErrorMissingValue error = errors.New("required config value is missing")
+var ErrorBadValue error = errors.New("config value can't be parsed")
+var ErrorNotStructPointer error = errors.New("config must be a pointer to struct")
+
+// Source gives raw config values by keys, ok is false if source has no value for key
+type Source interface {
+	Name() string
+	Lookup(key string) (string, bool, error)
+}
+
+// field of config struct, it is described by tags:
+//
+//	config:"key"      key in file, vault and environment, field without it is not configurable
+//	flag:"name"       flag name, kebab case of key by default
+//	usage:"text"      flag usage
+//	required:"true"   value must not be empty
+//	secret:"true"     value is masked when config is printed
+//	vault:"true"      value is looked up in vault too
+type field struct {
+	key      string
+	flag     string
+	usage    string
+	required bool
+	secret   bool
+	vault    bool
+	def      string // value of the field before loading
+	v        reflect.Value
+}
+
+// Loader fills config struct from defaults, file, vault, environment and flags, the later ones win
+type Loader struct {
+	dst     any
+	fields  []*field
+	fs      *flag.FlagSet
+	file    *string
+	origins map[string]string // key -> name of source its value came from
+	vault   *VaultSource      // set by Load if vault is used
+}
+
+// registers -config and a flag for every field of dst, current values of dst become defaults,
+// Load must be called after fs is parsed
+func NewLoader(fs *flag.FlagSet, dst any) (*Loader, error) {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil, ErrorNotStructPointer
+	}
+	ld := &Loader{dst: dst, fs: fs, origins: make(map[string]string)}
+	if err := ld.collect(rv.Elem()); err != nil {
+		return nil, err
+	}
+
+	ld.file = fs.String("config", "", "yaml config file, "+ConfigFileEnv+" is used if empty")
+	for _, f := range ld.fields {
+		fs.Var(&flagValue{s: f.def, isBool: f.v.Kind() == reflect.Bool}, f.flag, f.usage)
+	}
+	return ld, nil
+}
+
+// embedded structs are walked too, so common settings can be shared by services
+func (ld *Loader) collect(sv reflect.Value) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if err := ld.collect(sv.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		key := sf.Tag.Get("config")
+		if key == "" || !sf.IsExported() {
+			continue
+		}
+		f := &field{
+			key:      key,
+			flag:     sf.Tag.Get("flag"),
+			usage:    sf.Tag.Get("usage"),
+			required: sf.Tag.Get("required") == "true",
+			secret:   sf.Tag.Get("secret") == "true",
+			vault:    sf.Tag.Get("vault") == "true",
+			v:        sv.Field(i),
+		}
+		if f.flag == "" {
+			f.flag = splitKey(key, "-", unicode.ToLower)
+		}
+		def, err := formatValue(f.v)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, key)
+		}
+		f.def = def
+		ld.fields = append(ld.fields, f)
+	}
+	return nil
+}
+
+// vaultConfigurer is implemented by configs embedding Vault
+type vaultConfigurer interface {
+	vaultConfig() Vault
+}
+
+// configs which only say how to reach vault, like the one of envconfig itself, don't log in while loading
+func (ld *Loader) hasVaultFields() bool {
+	for _, f := range ld.fields {
+		if f.vault {
+			return true
+		}
+	}
+	return false
+}
+
+// fills dst, vault is asked only if vault address is configured by other sources and some fields are kept in it
+func (ld *Loader) Load() error {
+	ld.vault = nil
+	file := *ld.file
+	if file == "" {
+		file = os.Getenv(ConfigFileEnv)
+	}
+	sources := make([]Source, 0, 4)
+	if file != "" {
+		fsrc, err := NewFileSource(file)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, fsrc)
+	}
+	sources = append(sources, EnvSource{}, flagSource{ld.fs, ld.fields})
+	if err := ld.apply(sources); err != nil {
+		return err
+	}
+
+	if vc, ok := ld.dst.(vaultConfigurer); ok && vc.vaultConfig().VaultAddr != "" && ld.hasVaultFields() {
+		vsrc, err := NewVaultSource(vc.vaultConfig())
+		if err != nil {
+			return err
+		}
+		ld.vault = vsrc
+		sources = append(sources[:len(sources)-2], vsrc, sources[len(sources)-2], sources[len(sources)-1])
+		if err = ld.apply(sources); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range ld.fields {
+		if f.required && f.v.IsZero() {
+			return fmt.Errorf("%w: %s (flag -%s, env %s)", ErrorMissingValue, f.key, f.flag, EnvName(f.key))
+		}
+	}
+	if vd, ok := ld.dst.(interface{ Validate() error }); ok {
+		return vd.Validate()
+	}
+	return nil
+}
+
+// returns watcher of loaded values which came from vault, ok is false if vault is not used or polling is disabled,
+// values overridden by env or flags are not watched, so they don't change at runtime
+func (ld *Loader) Watcher() (*Watcher, bool) {
+	if ld.vault == nil || ld.vault.cfg.VaultPoll <= 0 {
+		return nil, false
+	}
+	w := NewWatcher(ld.vault.es, ld.vault.cfg.VaultPoll)
+	for _, f := range ld.fields {
+		if ld.origins[f.key] != vaultSourceName {
+			continue
+		}
+		value, _ := formatValue(f.v)
+		w.Add(f.key, value)
+	}
+	return w, true
+}
+
+// keeps vault token got by the last Load alive till ctx is done whether secrets are watched or not,
+// it returns at once and does nothing if vault is not used
+func (ld *Loader) KeepToken(ctx context.Context, onError func(err error)) {
+	if ld.vault == nil {
+		return
+	}
+	go ld.vault.es.KeepToken(ctx, onError)
+}
+
+// resets fields to defaults and sets every one to the value of the last source which has it
+func (ld *Loader) apply(sources []Source) error {
+	for _, f := range ld.fields {
+		raw, origin := f.def, "default"
+		for _, src := range sources {
+			if src.Name() == vaultSourceName && !f.vault {
+				continue
+			}
+			s, ok, err := src.Lookup(f.key)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", src.Name(), f.key, err)
+			}
+			if ok {
+				raw, origin = s, src.Name()
+			}
+		}
+		if err := parseValue(f.v, raw); err != nil {
+			return fmt.Errorf("%w: %s from %s: %v", ErrorBadValue, f.key, origin, err)
+		}
+		ld.origins[f.key] = origin
+	}
+	return nil
+}
+
+// writes effective config as yaml, every value is commented with the source it came from
+func (ld *Loader) Print(w io.Writer) error {
+	for _, f := range ld.fields {
+		s, err := formatValue(f.v)
+		if err != nil {
+			return err
+		}
+		if f.secret && s != "" {
+			s = "***"
+		}
+		if f.v.Kind() == reflect.String {
+			s = strconv.Quote(s)
+		}
+		origin := ld.origins[f.key]
+		if origin == "" {
+			origin = "default"
+		}
+		if _, err = fmt.Fprintf(w, "%s: %s # %s\n", f.key, s, origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splits camel case key into lower case words joined by sep, e.g. cacheTTL -> cache-ttl
+func splitKey(key string, sep string, conv func(rune) rune) string {
+	var sb strings.Builder
+	rs := []rune(key)
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(rs[i-1]) || unicode.IsDigit(rs[i-1])) {
+			sb.WriteString(sep)
+		}
+		sb.WriteRune(conv(r))
+	}
+	return sb.String()
+}
+
+func EnvName(key string) string {
+	return EnvPrefix + splitKey(key, "_", unicode.ToUpper)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func formatValue(v reflect.Value) (string, error) {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String(), nil
+	case v.Kind() == reflect.String:
+		return v.String(), nil
+	case v.Kind() == reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case v.CanInt():
+		return strconv.FormatInt(v.Int(), 10), nil
+	case v.CanFloat():
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	}
+	return "", fmt.Errorf("%w: unsupported type %s", ErrorBadValue, v.Type())
+}
+
+func parseValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.CanFloat():
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// flags keep raw strings, so they are applied together with other sources and only if they were set
+type flagValue struct {
+	s      string
+	isBool bool
+}
+
+func (fv *flagValue) String() string {
+	if fv == nil {
+		return ""
+	}
+	return fv.s
+}
+
+func (fv *flagValue) Set(s string) error {
+	fv.s = s
+	return nil
+}
+
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.isBool
+}
+
+type flagSource struct {
+	fs     *flag.FlagSet
+	fields []*field
+}
+
+func (flagSource) Name() string {
+	return "flag"
+}
+
+func (src flagSource) Lookup(key string) (string, bool, error) {
+	for _, f := range src.fields {
+		if f.key != key {
+			continue
+		}
+		set := false
+		src.fs.Visit(func(fl *flag.Flag) { set = set || fl.Name == f.flag })
+		if !set {
+			return "", false, nil
+		}
+		return src.fs.Lookup(f.flag).Value.String(), true, nil
+	}
+	return "", false, nil
+}
+
+// EnvSource reads CHAT_ prefixed environment variables
+type EnvSource struct{}
+
+func (EnvSource) Name() string {
+	return "env"
+}
+
+func (EnvSource) Lookup(key string) (string, bool, error) {
+	s, ok := os.LookupEnv(EnvName(key))
+	return s, ok, nil
+}
+
+// FileSource reads flat yaml mapping of config keys to scalar values
+type FileSource struct {
+	path   string
+	values map[string]any
+}
+
+func NewFileSource(path string) (*FileSource, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	if err = yaml.Unmarshal(buf, &values); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return &FileSource{path: path, values: values}, nil
+}
+
+func (src *FileSource) Name() string {
+	return "file " + src.path
+}
+
+func (src *FileSource) Lookup(key string) (string, bool, error) {
+	v, ok := src.values[key]
+	if !ok || v == nil {
+		return "", false, nil
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		return "", false, fmt.Errorf("%w: value must be a scalar", ErrorBadValue)
+	}
+	return fmt.Sprint(v), true, nil
+}
@@ -2,7 +2,10 @@ module envconfig
 
 go 1.21.5
 
-require github.com/hashicorp/vault/api v1.13.0
+require (
+	github.com/hashicorp/vault/api v1.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cenkalti/backoff/v3 v3.0.0 // indirect
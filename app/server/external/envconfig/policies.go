@@ -0,0 +1,27 @@
+package envconfig
+
+import (
+	"embed"
+	"path"
+	"strings"
+)
+
+//go:embed policies/*.hcl
+var policyFiles embed.FS
+
+// returns vault policy of every service by its name, policies are written for the default mount and are adjusted to mount
+func Policies(mount string) (map[string]string, error) {
+	entries, err := policyFiles.ReadDir("policies")
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]string, len(entries))
+	for _, e := range entries {
+		buf, err := policyFiles.ReadFile(path.Join("policies", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		policies[strings.TrimSuffix(e.Name(), ".hcl")] = strings.ReplaceAll(string(buf), `"`+DefaultVaultMount+`/data/`, `"`+mount+`/data/`)
+	}
+	return policies, nil
+}
@@ -0,0 +1,2 @@
+# client only needs the address of load balancer
+path "secret/data/serverOutsideAddr" { capabilities = ["read"] }
@@ -0,0 +1,6 @@
+# server listens for clients, sends messages to kafka, asks storage and keeps presence in redis
+path "secret/data/serverAddr" { capabilities = ["read"] }
+path "secret/data/kafkaAddr" { capabilities = ["read"] }
+path "secret/data/storageServerAddr" { capabilities = ["read"] }
+path "secret/data/redisAddr" { capabilities = ["read"] }
+path "secret/data/authSecret" { capabilities = ["read"] }
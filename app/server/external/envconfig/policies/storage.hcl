@@ -0,0 +1,6 @@
+# storage consumes messages from kafka, keeps them in postgres and redis and serves servers
+path "secret/data/kafkaAddr" { capabilities = ["read"] }
+path "secret/data/messageTopics" { capabilities = ["read"] }
+path "secret/data/postgresAddr" { capabilities = ["read"] }
+path "secret/data/redisAddr" { capabilities = ["read"] }
+path "secret/data/storageServerAddr" { capabilities = ["read"] }
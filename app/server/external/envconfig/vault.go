@@ -2,53 +2,281 @@ package envconfig
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 )
 
-const serviceEnvAddr = "http://vault:8200"
-const outsideEnvAddr = "http://localhost:8200"
+const DefaultVaultMount = "secret"
+const DefaultPollInterval = 30 * time.Second
+const VaultTimeout = 5 * time.Second
+
+var ErrorBadSecret error = errors.New("secret has no string value")
+var ErrorVaultNotReady error = errors.New("vault is sealed or not initialized")
+var ErrorSecretNotFound error = errors.New("secret not found")
+
+// config values are kept in this field of secrets named by config keys
+const AddrField = "addr"
 
 type EnvStorage struct {
-	c *vault.Client
+	c     *vault.Client
+	mount string // kv v2 secrets engine
+	auth  *tokenAuth
 }
 
-func connectToVault(addr string) *vault.Client {
+func newVaultClient(addr string) (*vault.Client, error) {
 	config := vault.DefaultConfig()
 	config.Address = addr
-	c, err := vault.NewClient(config)
+	config.Timeout = VaultTimeout
+	return vault.NewClient(config) // takes VAULT_TOKEN if it is set
+}
+
+// logs in by configured auth method, KeepToken should be run if storage is used for long,
+// services get it done by Loader.KeepToken
+func NewVaultStorage(cfg Vault) (EnvStorage, error) {
+	es, err := OpenVaultStorage(cfg)
 	if err != nil {
-		log.Fatalf("Unable to initialize Vault client: %v", err)
+		return EnvStorage{}, err
+	}
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	if err = es.Login(ctx); err != nil {
+		return EnvStorage{}, err
 	}
+	return es, nil
+}
 
-	c.SetToken("dev-only-token")
-	return c
+// doesn't talk to vault, so Ready may be waited for before Login
+func OpenVaultStorage(cfg Vault) (EnvStorage, error) {
+	c, err := newVaultClient(cfg.VaultAddr)
+	if err != nil {
+		return EnvStorage{}, err
+	}
+	ta, err := newTokenAuth(c, cfg)
+	if err != nil {
+		return EnvStorage{}, err
+	}
+	mount := cfg.VaultMount
+	if mount == "" {
+		mount = DefaultVaultMount
+	}
+	return EnvStorage{c, mount, ta}, nil
+}
+
+// logs in by configured auth method, storage must be logged in before anything else is done with it
+func (es EnvStorage) Login(ctx context.Context) error {
+	if err := es.auth.login(ctx); err != nil {
+		return fmt.Errorf("vault %s auth: %w", es.auth.method, err)
+	}
+	return nil
 }
 
-func NewEnvStorage() EnvStorage {
-	return EnvStorage{connectToVault(serviceEnvAddr)}
+// renews token before it expires and logs in again once it can't be renewed, blocks till ctx is done,
+// must not be run twice for the same storage
+func (es EnvStorage) KeepToken(ctx context.Context, onError func(err error)) {
+	if es.auth != nil {
+		es.auth.keep(ctx, onError)
+	}
 }
 
-func NewEnvClientStorage() EnvStorage {
-	return EnvStorage{connectToVault(outsideEnvAddr)}
+func (es EnvStorage) EnvUpdateAddr(app string, addr string) error {
+	_, err := es.Update(app, map[string]string{AddrField: addr})
+	return err
 }
 
-func (es EnvStorage) EnvUpdateAddr(app string, addr string) {
-	if _, err := es.c.KVv2("secret").Put(context.Background(), app, map[string]interface{}{"addr": addr}); err != nil {
-		log.Fatalf("Unable to write secret: %v", err)
+func (es EnvStorage) EnvGetAddr(app string) (string, error) {
+	rA, ok, err := es.Lookup(app)
+	if err != nil {
+		return "", err
 	}
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrorSecretNotFound, app)
+	}
+	return rA, nil
+}
+
+// reads value of secret app, ok is false if there is no such secret
+func (es EnvStorage) Lookup(app string) (string, bool, error) {
+	rA, _, ok, err := es.LookupVersion(app)
+	return rA, ok, err
 }
 
-func (es EnvStorage) EnvGetAddr(app string) string {
-	secret, err := es.c.KVv2("secret").Get(context.Background(), app)
+// like Lookup, but gives kv version of secret too
+func (es EnvStorage) LookupVersion(app string) (string, int, bool, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	secret, err := es.c.KVv2(es.mount).Get(ctx, app)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return "", 0, false, nil
+	}
 	if err != nil {
-		log.Fatalf("Unable to read secret: %v", err)
+		return "", 0, false, err
 	}
 
-	rA, ok := secret.Data["addr"].(string)
+	rA, ok := secret.Data[AddrField].(string)
 	if !ok {
-		log.Fatalf("Value type assertion failed: %T %#v", secret.Data["addr"], secret.Data["addr"])
+		return "", 0, false, fmt.Errorf("%w: %s: %T %#v", ErrorBadSecret, app, secret.Data[AddrField], secret.Data[AddrField])
+	}
+	version := 0
+	if secret.VersionMetadata != nil {
+		version = secret.VersionMetadata.Version
+	}
+	return rA, version, true, nil
+}
+
+// reads every field of secret app, ok is false if there is no such secret
+func (es EnvStorage) Get(app string) (map[string]string, bool, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	secret, err := es.c.KVv2(es.mount).Get(ctx, app)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return nil, false, nil
 	}
-	return rA
+	if err != nil {
+		return nil, false, err
+	}
+
+	values := make(map[string]string, len(secret.Data))
+	for field, v := range secret.Data {
+		switch v.(type) {
+		case map[string]any, []any, nil:
+			return nil, false, fmt.Errorf("%w: %s.%s: %T", ErrorBadSecret, app, field, v)
+		}
+		values[field] = fmt.Sprint(v)
+	}
+	return values, true, nil
+}
+
+// replaces every field of secret app
+func (es EnvStorage) Put(app string, values map[string]string) error {
+	data := make(map[string]any, len(values))
+	for field, v := range values {
+		data[field] = v
+	}
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	_, err := es.c.KVv2(es.mount).Put(ctx, app, data)
+	return err
+}
+
+// sets given fields of secret app keeping the other ones, new version is written only if something changes,
+// returns true if it was written
+func (es EnvStorage) Update(app string, values map[string]string) (bool, error) {
+	cur, exists, err := es.Get(app)
+	if err != nil {
+		return false, err
+	}
+	merged := make(map[string]string, len(cur)+len(values))
+	for field, v := range cur {
+		merged[field] = v
+	}
+	changed := !exists
+	for field, v := range values {
+		old, ok := cur[field]
+		changed = changed || !ok || old != v
+		merged[field] = v
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, es.Put(app, merged)
+}
+
+// returns names of every secret of the mount, secrets in folders are named by their paths
+func (es EnvStorage) List() ([]string, error) {
+	return es.list("")
+}
+
+func (es EnvStorage) list(folder string) ([]string, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), VaultTimeout)
+	defer cncl()
+	secret, err := es.c.Logical().ListWithContext(ctx, path.Join(es.mount, "metadata", folder))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return []string{}, nil
+	}
+	keys, _ := secret.Data["keys"].([]any)
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		name := folder + fmt.Sprint(k)
+		if !strings.HasSuffix(name, "/") {
+			names = append(names, name)
+			continue
+		}
+		sub, err := es.list(name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sub...)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// waits till vault is initialized and unsealed
+func (es EnvStorage) Ready(ctx context.Context) error {
+	for {
+		health, err := es.c.Sys().HealthWithContext(ctx)
+		if err == nil && health.Initialized && !health.Sealed {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ErrorVaultNotReady
+			}
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Vault is embedded by service configs, vault is used as config source only if address is set
+type Vault struct {
+	VaultAddr         string        `config:"vaultAddr" usage:"vault address, vault is not used if empty"`
+	VaultAuth         string        `config:"vaultAuth" usage:"vault auth method: token, token-file or approle, inferred from given credentials if empty"`
+	VaultToken        string        `config:"vaultToken" secret:"true" usage:"vault token, VAULT_TOKEN is used if empty"`
+	VaultTokenFile    string        `config:"vaultTokenFile" usage:"file with vault token, it is read again when token expires"`
+	VaultRoleId       string        `config:"vaultRoleId" usage:"approle role id"`
+	VaultRoleIdFile   string        `config:"vaultRoleIdFile" usage:"file with approle role id"`
+	VaultSecretId     string        `config:"vaultSecretId" secret:"true" usage:"approle secret id"`
+	VaultSecretIdFile string        `config:"vaultSecretIdFile" usage:"file with approle secret id"`
+	VaultAppRoleMount string        `config:"vaultAppRoleMount" usage:"mount of approle auth method"`
+	VaultMount        string        `config:"vaultMount" usage:"mount of vault kv v2 secrets engine"`
+	VaultPoll         time.Duration `config:"vaultPollInterval" usage:"how often secrets are checked for changes, 0 disables watching"`
+}
+
+func (v Vault) vaultConfig() Vault {
+	return v
+}
+
+const vaultSourceName = "vault"
+
+// VaultSource reads fields tagged with vault:"true" from secrets named by their keys
+type VaultSource struct {
+	es  EnvStorage
+	cfg Vault
+}
+
+func NewVaultSource(cfg Vault) (*VaultSource, error) {
+	es, err := NewVaultStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultSource{es, cfg}, nil
+}
+
+func (*VaultSource) Name() string {
+	return vaultSourceName
+}
+
+func (src *VaultSource) Lookup(key string) (string, bool, error) {
+	return src.es.Lookup(key)
 }
@@ -0,0 +1,354 @@
+// Package vaultfake is an in-process stand-in for vault, so envconfig can be checked without running vault.
+// It serves kv v2 secrets, token and approle auth with expiring and renewable tokens, policies and health,
+// policies are stored but not enforced.
+package vaultfake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type token struct {
+	policies  []string
+	ttl       time.Duration // 0 for tokens which never expire
+	maxTTL    time.Duration
+	renewable bool
+	issued    time.Time
+	expires   time.Time
+}
+
+type role struct {
+	roleId    string
+	secretIds map[string]bool
+	policies  []string
+	ttl       time.Duration
+	maxTTL    time.Duration
+}
+
+type kvSecret struct {
+	data     map[string]any
+	version  int
+	modified time.Time
+}
+
+// Server implements http.Handler, it is usually started by httptest.NewServer
+type Server struct {
+	RootToken string
+
+	tokens    map[string]*token
+	roles     map[string]map[string]*role // auth mount -> role name -> role
+	authMount map[string]string           // path -> type
+	policies  map[string]string
+	kv        map[string]map[string]*kvSecret // kv mount -> name -> secret
+	mu        *sync.Mutex
+}
+
+// returns server with root token which never expires, kv v2 engine on secret mount and approle auth on approle mount
+func New() *Server {
+	s := &Server{
+		tokens:    make(map[string]*token),
+		roles:     map[string]map[string]*role{"approle": {}},
+		authMount: map[string]string{"token": "token", "approle": "approle"},
+		policies:  make(map[string]string),
+		kv:        map[string]map[string]*kvSecret{"secret": {}},
+		mu:        &sync.Mutex{},
+	}
+	s.RootToken = s.issue([]string{"root"}, 0, 0, false)
+	return s
+}
+
+func newId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// mu must be held
+func (s *Server) issue(policies []string, ttl time.Duration, maxTTL time.Duration, renewable bool) string {
+	id := newId()
+	now := time.Now()
+	t := &token{policies: policies, ttl: ttl, maxTTL: maxTTL, renewable: renewable, issued: now}
+	if ttl > 0 {
+		t.expires = now.Add(ttl)
+	}
+	s.tokens[id] = t
+	return id
+}
+
+// issues token with ttl, it can be renewed up to maxTTL if renewable
+func (s *Server) IssueToken(ttl time.Duration, maxTTL time.Duration, renewable bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issue([]string{"default"}, ttl, maxTTL, renewable)
+}
+
+func (s *Server) RevokeToken(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+}
+
+// creates approle role on approle mount, tokens got by logging in live for ttl and are renewable up to maxTTL
+func (s *Server) AddRole(name string, policies []string, ttl time.Duration, maxTTL time.Duration) (roleId string, secretId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &role{roleId: newId(), secretIds: map[string]bool{}, policies: policies, ttl: ttl, maxTTL: maxTTL}
+	secretId = newId()
+	r.secretIds[secretId] = true
+	s.roles["approle"][name] = r
+	return r.roleId, secretId
+}
+
+// returns policy written by name
+func (s *Server) Policy(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.policies[name]
+	return p, ok
+}
+
+// returns data of the last version of kv v2 secret
+func (s *Server) Secret(mount string, name string) (map[string]any, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sec, ok := s.kv[mount][name]
+	if !ok {
+		return nil, 0, false
+	}
+	return sec.data, sec.version, true
+}
+
+// writes new version of kv v2 secret like vault kv put does
+func (s *Server) PutSecret(mount string, name string, data map[string]any) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putSecret(mount, name, data)
+}
+
+// mu must be held
+func (s *Server) putSecret(mount string, name string, data map[string]any) int {
+	if s.kv[mount] == nil {
+		s.kv[mount] = make(map[string]*kvSecret)
+	}
+	sec, ok := s.kv[mount][name]
+	if !ok {
+		sec = &kvSecret{}
+		s.kv[mount][name] = sec
+	}
+	sec.data, sec.modified = data, time.Now()
+	sec.version++
+	return sec.version
+}
+
+type response struct {
+	status int
+	body   any
+}
+
+func reply(body any) response {
+	return response{http.StatusOK, body}
+}
+
+func fail(status int, msg string) response {
+	return response{status, map[string]any{"errors": []string{msg}}}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	resp := s.handle(r)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.body == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
+
+// mu must be held
+func (s *Server) handle(r *http.Request) response {
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	if p == "sys/health" {
+		return reply(map[string]any{"initialized": true, "sealed": false, "standby": false, "version": "fake"})
+	}
+	var body map[string]any
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	if mount, ok := strings.CutSuffix(p, "/login"); ok && strings.HasPrefix(mount, "auth/") {
+		return s.login(strings.TrimPrefix(mount, "auth/"), body)
+	}
+
+	t, ok := s.tokens[r.Header.Get("X-Vault-Token")]
+	if !ok || (!t.expires.IsZero() && time.Now().After(t.expires)) {
+		return fail(http.StatusForbidden, "permission denied")
+	}
+	list := r.Method == "LIST" || r.URL.Query().Get("list") == "true"
+
+	switch {
+	case p == "auth/token/lookup-self":
+		return reply(map[string]any{"data": s.tokenData(r.Header.Get("X-Vault-Token"), t)})
+	case p == "auth/token/renew-self":
+		return s.renew(r.Header.Get("X-Vault-Token"), t)
+	case p == "sys/auth" && r.Method == http.MethodGet:
+		mounts := make(map[string]any, len(s.authMount))
+		for path, typ := range s.authMount {
+			mounts[path+"/"] = map[string]any{"type": typ}
+		}
+		return reply(map[string]any{"data": mounts})
+	case strings.HasPrefix(p, "sys/auth/"):
+		path := strings.TrimPrefix(p, "sys/auth/")
+		typ, _ := body["type"].(string)
+		s.authMount[path] = typ
+		if typ == "approle" && s.roles[path] == nil {
+			s.roles[path] = make(map[string]*role)
+		}
+		return response{}
+	case strings.HasPrefix(p, "sys/policies/acl/"):
+		rules, _ := body["policy"].(string)
+		s.policies[strings.TrimPrefix(p, "sys/policies/acl/")] = rules
+		return response{}
+	case strings.HasPrefix(p, "auth/"):
+		return s.handleRole(strings.TrimPrefix(p, "auth/"), r.Method, body)
+	}
+
+	mount, rest, _ := strings.Cut(p, "/")
+	kind, name, _ := strings.Cut(rest, "/")
+	if s.kv[mount] == nil {
+		return fail(http.StatusNotFound, "no handler for route")
+	}
+	switch {
+	case kind == "metadata" && list:
+		return s.listSecrets(mount, name)
+	case kind == "data" && r.Method == http.MethodGet:
+		sec, ok := s.kv[mount][name]
+		if !ok {
+			return fail(http.StatusNotFound, "")
+		}
+		return reply(map[string]any{"data": map[string]any{"data": sec.data, "metadata": versionMetadata(sec)}})
+	case kind == "data":
+		data, _ := body["data"].(map[string]any)
+		s.putSecret(mount, name, data)
+		return reply(map[string]any{"data": versionMetadata(s.kv[mount][name])})
+	}
+	return fail(http.StatusNotFound, "no handler for route")
+}
+
+func versionMetadata(sec *kvSecret) map[string]any {
+	return map[string]any{"version": sec.version, "created_time": sec.modified.Format(time.RFC3339Nano), "deletion_time": "", "destroyed": false}
+}
+
+// mu must be held
+func (s *Server) listSecrets(mount string, folder string) response {
+	if folder != "" {
+		folder += "/"
+	}
+	seen := map[string]bool{}
+	for name := range s.kv[mount] {
+		rest, ok := strings.CutPrefix(name, folder)
+		if !ok {
+			continue
+		}
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			rest = sub + "/"
+		}
+		seen[rest] = true
+	}
+	if len(seen) == 0 {
+		return fail(http.StatusNotFound, "")
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return reply(map[string]any{"data": map[string]any{"keys": keys}})
+}
+
+func (s *Server) tokenData(id string, t *token) map[string]any {
+	ttl := 0
+	if !t.expires.IsZero() {
+		ttl = int(time.Until(t.expires).Seconds())
+	}
+	return map[string]any{"id": id, "policies": t.policies, "ttl": ttl, "renewable": t.renewable}
+}
+
+func authBody(id string, t *token) map[string]any {
+	return map[string]any{"auth": map[string]any{"client_token": id, "policies": t.policies, "token_policies": t.policies, "lease_duration": int(t.ttl.Seconds()), "renewable": t.renewable}}
+}
+
+// token is extended by its ttl, but not beyond max ttl counted from issue time
+func (s *Server) renew(id string, t *token) response {
+	if !t.renewable {
+		return fail(http.StatusBadRequest, "lease is not renewable")
+	}
+	expires := time.Now().Add(t.ttl)
+	if t.maxTTL > 0 && expires.After(t.issued.Add(t.maxTTL)) {
+		expires = t.issued.Add(t.maxTTL)
+	}
+	t.expires = expires
+	resp := authBody(id, t)
+	resp["auth"].(map[string]any)["lease_duration"] = int(time.Until(expires).Seconds())
+	return reply(resp)
+}
+
+// mu must be held
+func (s *Server) login(mount string, body map[string]any) response {
+	roleId, _ := body["role_id"].(string)
+	secretId, _ := body["secret_id"].(string)
+	for _, r := range s.roles[mount] {
+		if r.roleId == roleId && r.secretIds[secretId] {
+			id := s.issue(r.policies, r.ttl, r.maxTTL, r.ttl > 0)
+			return reply(authBody(id, s.tokens[id]))
+		}
+	}
+	return fail(http.StatusBadRequest, "invalid role or secret ID")
+}
+
+// mu must be held
+func (s *Server) handleRole(p string, method string, body map[string]any) response {
+	parts := strings.Split(p, "/")
+	if len(parts) < 3 || parts[1] != "role" || s.roles[parts[0]] == nil {
+		return fail(http.StatusNotFound, "no handler for route")
+	}
+	roles, name := s.roles[parts[0]], parts[2]
+	if len(parts) == 3 {
+		r, ok := roles[name]
+		if !ok {
+			r = &role{roleId: newId(), secretIds: map[string]bool{}}
+			roles[name] = r
+		}
+		if policy, ok := body["token_policies"].(string); ok {
+			r.policies = strings.Split(policy, ",")
+		}
+		if ttl, ok := body["token_ttl"].(float64); ok {
+			r.ttl = time.Duration(ttl) * time.Second
+		}
+		if maxTTL, ok := body["token_max_ttl"].(float64); ok {
+			r.maxTTL = time.Duration(maxTTL) * time.Second
+		}
+		return response{}
+	}
+
+	r, ok := roles[name]
+	if !ok {
+		return fail(http.StatusNotFound, "role not found")
+	}
+	switch {
+	case parts[3] == "role-id" && method == http.MethodGet:
+		return reply(map[string]any{"data": map[string]any{"role_id": r.roleId}})
+	case parts[3] == "secret-id":
+		secretId := newId()
+		r.secretIds[secretId] = true
+		return reply(map[string]any{"data": map[string]any{"secret_id": secretId}})
+	}
+	return fail(http.StatusNotFound, "no handler for route")
+}
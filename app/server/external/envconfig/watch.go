@@ -0,0 +1,109 @@
+package envconfig
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrorNotWatched error = errors.New("key is not watched")
+
+type watchedKey struct {
+	value   string
+	version int
+	subs    []func(value string) error
+}
+
+// Watcher polls vault secrets and calls subscribers of the ones whose value changed.
+// kv v2 secrets have no leases to renew, so every poll compares secret versions instead
+type Watcher struct {
+	es       EnvStorage
+	interval time.Duration
+	keys     map[string]*watchedKey
+	mu       *sync.Mutex
+}
+
+func NewWatcher(es EnvStorage, interval time.Duration) *Watcher {
+	return &Watcher{es: es, interval: interval, keys: make(map[string]*watchedKey), mu: &sync.Mutex{}}
+}
+
+// starts watching key, value is the one currently used, so subscribers are called only if it changes later
+func (w *Watcher) Add(key string, value string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.keys[key]; !ok {
+		w.keys[key] = &watchedKey{value: value, version: -1}
+	}
+}
+
+// fn is called with every new value of key from the goroutine running Run,
+// if it fails the value is not taken and fn is called with it again on the next poll
+func (w *Watcher) Subscribe(key string, fn func(value string) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wk, ok := w.keys[key]
+	if !ok {
+		return ErrorNotWatched
+	}
+	wk.subs = append(wk.subs, fn)
+	return nil
+}
+
+// polls secrets till ctx is done, errors of reads and subscribers are passed to onError if it isn't nil.
+// token used by watcher is kept alive by Loader.KeepToken
+func (w *Watcher) Run(ctx context.Context, onError func(key string, err error)) {
+	if onError == nil {
+		onError = func(string, error) {}
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll(onError)
+		}
+	}
+}
+
+func (w *Watcher) poll(onError func(key string, err error)) {
+	w.mu.Lock()
+	keys := make(map[string]*watchedKey, len(w.keys))
+	for key, wk := range w.keys {
+		keys[key] = wk
+	}
+	w.mu.Unlock()
+
+	for key, wk := range keys {
+		value, version, ok, err := w.es.LookupVersion(key)
+		if err != nil {
+			onError(key, err)
+			continue
+		}
+		if !ok || version == wk.version {
+			continue
+		}
+		if value != wk.value && !w.notify(key, wk, value, onError) {
+			continue
+		}
+		wk.value, wk.version = value, version
+	}
+}
+
+// returns true if every subscriber took value
+func (w *Watcher) notify(key string, wk *watchedKey, value string, onError func(key string, err error)) bool {
+	w.mu.Lock()
+	subs := wk.subs
+	w.mu.Unlock()
+
+	taken := true
+	for _, fn := range subs {
+		if err := fn(value); err != nil {
+			onError(key, err)
+			taken = false
+		}
+	}
+	return taken
+}
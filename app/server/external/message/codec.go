@@ -0,0 +1,150 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// websocket subprotocols negotiated on upgrade, connection without subprotocol speaks json
+const JsonSubprotocol = "chat.v1.json"
+const GobSubprotocol = "chat.gob" // legacy, bare gob encoded Message of clients written before envelopes
+
+const ProtocolVersion = 1
+
+// envelope types of json protocol, see docs/websocket-protocol.md
+const (
+	EnvelopeSend           = "send"
+	EnvelopeReceive        = "receive"
+	EnvelopeHistoryRequest = "history_request"
+	EnvelopeHistory        = "history"
+	EnvelopeError          = "error"
+	EnvelopeAck            = "ack"
+)
+
+var ErrorUnsupportedVersion error = errors.New("unsupported protocol version")
+var ErrorUnknownEnvelopeType error = errors.New("unknown envelope type")
+var ErrorEmptyFrame error = errors.New("frame has nothing to send")
+var ErrorNotInLegacyProtocol error = errors.New("legacy protocol carries only messages")
+
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type FrameCodec interface {
+	Subprotocol() string
+	EncodeFrame(Frame) ([]byte, error)
+	DecodeFrame([]byte) (Frame, error)
+}
+
+func newCodec(subprotocol string, outMsgType string) FrameCodec {
+	if subprotocol == GobSubprotocol {
+		return legacyCodec{}
+	}
+	return jsonCodec{outMsgType: outMsgType}
+}
+
+// codec for the server side of connection with negotiated subprotocol
+func NewServerCodec(subprotocol string) FrameCodec {
+	return newCodec(subprotocol, EnvelopeReceive)
+}
+
+// codec for the client side of connection with negotiated subprotocol
+func NewClientCodec(subprotocol string) FrameCodec {
+	return newCodec(subprotocol, EnvelopeSend)
+}
+
+// legacy protocol has no envelope, every frame is a gob encoded Message,
+// so acks, errors and history are not sent to its clients
+type legacyCodec struct{}
+
+func (legacyCodec) Subprotocol() string {
+	return GobSubprotocol
+}
+
+func (legacyCodec) EncodeFrame(f Frame) ([]byte, error) {
+	if f.Msg == nil {
+		return nil, ErrorNotInLegacyProtocol
+	}
+	return EncodeMsgsToBytes(*f.Msg)
+}
+
+func (legacyCodec) DecodeFrame(b []byte) (Frame, error) {
+	msg, err := DecodeMsgFromBytes(b)
+	if err != nil {
+		return Frame{}, err
+	}
+	return NewMsgFrame(msg), nil
+}
+
+type jsonCodec struct {
+	outMsgType string // chat message is sent by client and received by server, so its type depends on side
+}
+
+func (jsonCodec) Subprotocol() string {
+	return JsonSubprotocol
+}
+
+func (jc jsonCodec) EncodeFrame(f Frame) ([]byte, error) {
+	var tp string
+	var payload any
+	switch {
+	case f.Msg != nil:
+		tp, payload = jc.outMsgType, f.Msg
+	case f.HistReq != nil:
+		tp, payload = EnvelopeHistoryRequest, f.HistReq
+	case f.HistResp != nil:
+		tp, payload = EnvelopeHistory, f.HistResp
+	case f.Err != nil:
+		tp, payload = EnvelopeError, f.Err
+	case f.Ack != nil:
+		tp, payload = EnvelopeAck, f.Ack
+	default:
+		return nil, ErrorEmptyFrame
+	}
+
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Type: tp, Version: ProtocolVersion, Payload: p})
+}
+
+func (jsonCodec) DecodeFrame(b []byte) (Frame, error) {
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return Frame{}, err
+	}
+	if env.Version != ProtocolVersion {
+		return Frame{}, fmt.Errorf("%w: %d", ErrorUnsupportedVersion, env.Version)
+	}
+
+	var f Frame
+	var payload any
+	switch env.Type {
+	case EnvelopeSend, EnvelopeReceive:
+		f.Msg = &Message{}
+		payload = f.Msg
+	case EnvelopeHistoryRequest:
+		f.HistReq = &HistoryRequest{}
+		payload = f.HistReq
+	case EnvelopeHistory:
+		f.HistResp = &HistoryResponse{}
+		payload = f.HistResp
+	case EnvelopeError:
+		f.Err = &FrameError{}
+		payload = f.Err
+	case EnvelopeAck:
+		f.Ack = &Ack{}
+		payload = f.Ack
+	default:
+		return Frame{}, fmt.Errorf("%w: %q", ErrorUnknownEnvelopeType, env.Type)
+	}
+
+	if err := json.Unmarshal(env.Payload, payload); err != nil {
+		return Frame{}, err
+	}
+	return f, nil
+}
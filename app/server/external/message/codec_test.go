@@ -0,0 +1,138 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newTestMessage() Message {
+	msg := Message{User: "tester", Text: "hello"}
+	msg.SetId(7)
+	msg.SetClientId("c-1")
+	msg.SetUserId(3)
+	msg.SetChatId(2)
+	return msg
+}
+
+func TestJsonRoundTrip(t *testing.T) {
+	msg := newTestMessage()
+	tests := []struct {
+		name   string
+		f      Frame
+		tp     string
+		encode FrameCodec
+		decode FrameCodec
+	}{
+		{"send", NewMsgFrame(msg), EnvelopeSend, NewClientCodec(JsonSubprotocol), NewServerCodec(JsonSubprotocol)},
+		{"receive", NewMsgFrame(msg), EnvelopeReceive, NewServerCodec(JsonSubprotocol), NewClientCodec(JsonSubprotocol)},
+		{"history request", NewHistReqFrame(10, 5), EnvelopeHistoryRequest, NewClientCodec(JsonSubprotocol), NewServerCodec(JsonSubprotocol)},
+		{"history", NewHistRespFrame([]Message{msg}, 7), EnvelopeHistory, NewServerCodec(JsonSubprotocol), NewClientCodec(JsonSubprotocol)},
+		{"error", NewMsgErrFrame(ErrCodeInternal, "boom", "c-1"), EnvelopeError, NewServerCodec(JsonSubprotocol), NewClientCodec(JsonSubprotocol)},
+		{"ack", NewAckFrame("c-1", AckStatusPersisted, 7), EnvelopeAck, NewServerCodec(JsonSubprotocol), NewClientCodec(JsonSubprotocol)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.encode.EncodeFrame(tt.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var env Envelope
+			if err = json.Unmarshal(b, &env); err != nil {
+				t.Fatal(err)
+			}
+			if env.Type != tt.tp || env.Version != ProtocolVersion {
+				t.Errorf("envelope = %s v%d, want %s v%d", env.Type, env.Version, tt.tp, ProtocolVersion)
+			}
+
+			got, err := tt.decode.DecodeFrame(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.f) {
+				t.Errorf("decoded %+v, want %+v", got, tt.f)
+			}
+		})
+	}
+}
+
+func TestJsonRejectsBadEnvelopes(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+		err  error
+	}{
+		{"version", `{"type":"send","version":2,"payload":{}}`, ErrorUnsupportedVersion},
+		{"type", `{"type":"typing","version":1,"payload":{}}`, ErrorUnknownEnvelopeType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServerCodec(JsonSubprotocol).DecodeFrame([]byte(tt.b)); !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := NewServerCodec(JsonSubprotocol).EncodeFrame(Frame{}); !errors.Is(err, ErrorEmptyFrame) {
+		t.Errorf("empty frame err = %v, want %v", err, ErrorEmptyFrame)
+	}
+}
+
+func TestLegacyRoundTrip(t *testing.T) {
+	msg := newTestMessage()
+	server, client := NewServerCodec(GobSubprotocol), NewClientCodec(GobSubprotocol)
+
+	// old client sends bare message
+	b, err := EncodeMsgsToBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := server.DecodeFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, NewMsgFrame(msg)) {
+		t.Errorf("decoded %+v, want message frame of %+v", f, msg)
+	}
+
+	// and gets bare message back
+	if b, err = server.EncodeFrame(NewMsgFrame(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeMsgFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Errorf("decoded %+v, want %+v", got, msg)
+	}
+	if f, err = client.DecodeFrame(b); err != nil || !reflect.DeepEqual(f, NewMsgFrame(msg)) {
+		t.Errorf("client decoded %+v, %v, want message frame of %+v", f, err, msg)
+	}
+}
+
+func TestLegacyCarriesOnlyMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		f    Frame
+	}{
+		{"history request", NewHistReqFrame(10, 5)},
+		{"history", NewHistRespFrame([]Message{newTestMessage()}, 7)},
+		{"error", NewErrFrame(ErrCodeBadFrame, "bad")},
+		{"ack", NewAckFrame("c-1", AckStatusAccepted, 0)},
+		{"empty", Frame{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServerCodec(GobSubprotocol).EncodeFrame(tt.f); !errors.Is(err, ErrorNotInLegacyProtocol) {
+				t.Errorf("err = %v, want %v", err, ErrorNotInLegacyProtocol)
+			}
+		})
+	}
+
+	if _, err := NewServerCodec(GobSubprotocol).DecodeFrame([]byte(`{"type":"send","version":1}`)); err == nil {
+		t.Error("json envelope is decoded by legacy codec")
+	}
+}
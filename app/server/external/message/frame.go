@@ -0,0 +1,71 @@
+package message
+
+// Frame is a unit sent through websocket between client and server, only one of its fields is set
+type Frame struct {
+	Msg      *Message
+	HistReq  *HistoryRequest
+	HistResp *HistoryResponse
+	Err      *FrameError
+	Ack      *Ack
+}
+
+// asks for Amount messages older than BeforeId, BeforeId <= 0 means the newest ones
+type HistoryRequest struct {
+	BeforeId int64 `json:"before_id"`
+	Amount   int   `json:"amount"`
+}
+
+// Msgs are sorted from newer to older, NextBeforeId should be used to ask for the next page
+type HistoryResponse struct {
+	Msgs         []Message `json:"messages"`
+	NextBeforeId int64     `json:"next_before_id"`
+}
+
+// server explanation why the last client frame was not processed
+type FrameError struct {
+	Code     string `json:"code"`
+	Text     string `json:"message"`
+	ClientId string `json:"client_id,omitempty"` // set if error is about the sent message
+}
+
+const (
+	ErrCodeBadFrame           = "bad_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInternal           = "internal"
+	ErrCodeNotDelivered       = "not_delivered"
+)
+
+// server confirmation of the client message
+type Ack struct {
+	ClientId string `json:"client_id"`
+	Status   string `json:"status"`
+	MsgId    int64  `json:"message_id,omitempty"` // known only when message is persisted
+}
+
+const AckStatusAccepted = "accepted"   // message is written to kafka
+const AckStatusPersisted = "persisted" // message is stored by storage service
+
+func NewMsgFrame(msg Message) Frame {
+	return Frame{Msg: &msg}
+}
+
+func NewHistReqFrame(bMsgId int64, amt int) Frame {
+	return Frame{HistReq: &HistoryRequest{BeforeId: bMsgId, Amount: amt}}
+}
+
+func NewHistRespFrame(msgs []Message, nbMsgId int64) Frame {
+	return Frame{HistResp: &HistoryResponse{Msgs: msgs, NextBeforeId: nbMsgId}}
+}
+
+func NewErrFrame(code string, text string) Frame {
+	return Frame{Err: &FrameError{Code: code, Text: text}}
+}
+
+func NewMsgErrFrame(code string, text string, cId string) Frame {
+	return Frame{Err: &FrameError{Code: code, Text: text, ClientId: cId}}
+}
+
+func NewAckFrame(cId string, status string, msgId int64) Frame {
+	return Frame{Ack: &Ack{ClientId: cId, Status: status, MsgId: msgId}}
+}
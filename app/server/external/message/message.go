@@ -9,10 +9,29 @@ import (
 )
 
 type Message struct {
-	User string
-	Text string
-	UId  int
-	CId  int
+	Id       int64  `json:"id"`                  // assigned by storage on persist, increases monotonically inside a chat
+	ClientId string `json:"client_id,omitempty"` // generated by sender to match acks with sent messages
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	UId      int    `json:"user_id"`
+	CId      int    `json:"chat_id"`
+	EventId  string `json:"-"` // unique for every sent message, storage skips redelivered events by it
+}
+
+func (m Message) GetId() int64 {
+	return m.Id
+}
+
+func (m *Message) SetId(id int64) {
+	m.Id = id
+}
+
+func (m Message) GetClientId() string {
+	return m.ClientId
+}
+
+func (m *Message) SetClientId(cId string) {
+	m.ClientId = cId
 }
 
 func (m Message) GetUserId() int {
@@ -31,6 +50,14 @@ func (m *Message) SetChatId(cId int) {
 	m.CId = cId
 }
 
+func (m Message) GetEventId() string {
+	return m.EventId
+}
+
+func (m *Message) SetEventId(eId string) {
+	m.EventId = eId
+}
+
 func DecodeMsgFromBytes(b []byte) (Message, error) {
 	var buf *bytes.Buffer = bytes.NewBuffer(b)
 	enc := gob.NewDecoder(buf)
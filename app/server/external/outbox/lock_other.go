@@ -0,0 +1,12 @@
+//go:build !unix
+
+package outbox
+
+import "os"
+
+// outbox dirs of running instances can't be told from orphaned ones, so none is adopted
+const locksFiles = false
+
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package outbox
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const locksFiles = true
+
+// lock is released by closing f, kernel releases it as well when the process dies
+func lockFile(f *os.File) error {
+	e := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(e, syscall.EWOULDBLOCK) {
+		return ErrorLocked
+	}
+	return e
+}
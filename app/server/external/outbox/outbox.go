@@ -0,0 +1,290 @@
+package outbox
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const fileName = "outbox.log"
+const lockName = "outbox.lock" // held by the process which opened outbox
+const CompactSize = 1 << 20    // log is truncated once nothing is pending and it grew bigger
+
+const (
+	kindPut byte = 1
+	kindAck byte = 2
+)
+
+const headerSize = 1 + 8 + 4 + 4 // kind, seq, payload len, payload crc
+
+var ErrorClosed error = errors.New("outbox is closed")
+var ErrorLocked error = errors.New("outbox is opened by another process")
+
+type Entry struct {
+	Seq     uint64
+	Payload []byte
+}
+
+// Outbox is an append-only log of records waiting to be delivered, put records are synced to disk before Put returns,
+// acks are not, so a crash may only cause redelivery
+type Outbox struct {
+	path    string
+	f       *os.File
+	lock    *os.File
+	size    int64
+	pending map[uint64][]byte
+	nextSeq uint64
+	mu      *sync.Mutex
+}
+
+// restores records which were put but not acked before, torn record at the end of log is dropped
+func Open(dir string) (*Outbox, error) {
+	if e := os.MkdirAll(dir, 0o755); e != nil {
+		return nil, e
+	}
+	lock, e := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0o644)
+	if e != nil {
+		return nil, e
+	}
+	if e = lockFile(lock); e != nil {
+		lock.Close()
+		return nil, e
+	}
+	ob := &Outbox{path: filepath.Join(dir, fileName), lock: lock, pending: make(map[uint64][]byte), nextSeq: 1, mu: &sync.Mutex{}}
+	if e = ob.replay(); e == nil {
+		e = ob.rewrite()
+	}
+	if e != nil {
+		lock.Close()
+		return nil, e
+	}
+	return ob, nil
+}
+
+// moves pending records of outboxes in other subdirectories of root which no running process holds into ob
+// and removes them, so records of an instance which was replaced by one with another name are not lost.
+// crash while adopting may only cause redelivery
+func (ob *Outbox) Adopt(root string) (int, error) {
+	if !locksFiles {
+		return 0, nil
+	}
+	entries, e := os.ReadDir(root)
+	if e != nil {
+		return 0, e
+	}
+	own := filepath.Dir(ob.path)
+	adopted := 0
+	for _, en := range entries {
+		dir := filepath.Join(root, en.Name())
+		if !en.IsDir() || dir == own {
+			continue
+		}
+		orphan, e := Open(dir)
+		if errors.Is(e, ErrorLocked) {
+			continue
+		}
+		if e != nil {
+			return adopted, e
+		}
+		for _, pen := range orphan.Pending() {
+			if _, e = ob.Put(pen.Payload); e != nil {
+				orphan.Close()
+				return adopted, e
+			}
+			adopted++
+		}
+		if e = orphan.remove(); e != nil {
+			return adopted, e
+		}
+	}
+	return adopted, nil
+}
+
+func (ob *Outbox) replay() error {
+	f, e := os.Open(ob.path)
+	if errors.Is(e, os.ErrNotExist) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	for {
+		if _, e = io.ReadFull(r, header); e != nil {
+			return nil // end of log or torn header
+		}
+		kind, seq := header[0], binary.BigEndian.Uint64(header[1:9])
+		payload := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+		if _, e = io.ReadFull(r, payload); e != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[13:17]) {
+			return nil
+		}
+
+		switch kind {
+		case kindPut:
+			ob.pending[seq] = payload
+		case kindAck:
+			delete(ob.pending, seq)
+		}
+		ob.nextSeq = max(ob.nextSeq, seq+1)
+	}
+}
+
+// replaces log with pending records only and opens it for appending
+func (ob *Outbox) rewrite() error {
+	tmpPath := ob.path + ".tmp"
+	tmp, e := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if e != nil {
+		return e
+	}
+	w := bufio.NewWriter(tmp)
+	var size int64
+	for _, en := range ob.pendingLocked() {
+		buf := encodeRecord(kindPut, en.Seq, en.Payload)
+		if _, e = w.Write(buf); e != nil {
+			tmp.Close()
+			return e
+		}
+		size += int64(len(buf))
+	}
+	if e = w.Flush(); e == nil {
+		e = tmp.Sync()
+	}
+	if e != nil {
+		tmp.Close()
+		return e
+	}
+	if e = tmp.Close(); e != nil {
+		return e
+	}
+	if e = os.Rename(tmpPath, ob.path); e != nil {
+		return e
+	}
+
+	if ob.f, e = os.OpenFile(ob.path, os.O_APPEND|os.O_WRONLY, 0o644); e != nil {
+		return e
+	}
+	ob.size = size
+	return nil
+}
+
+func encodeRecord(kind byte, seq uint64, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], seq)
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[13:17], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+func (ob *Outbox) append(kind byte, seq uint64, payload []byte) error {
+	if ob.f == nil {
+		return ErrorClosed
+	}
+	buf := encodeRecord(kind, seq, payload)
+	if _, e := ob.f.Write(buf); e != nil {
+		return e
+	}
+	ob.size += int64(len(buf))
+	return nil
+}
+
+// returns seq to ack payload with once it is delivered
+func (ob *Outbox) Put(payload []byte) (uint64, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	seq := ob.nextSeq
+	if e := ob.append(kindPut, seq, payload); e != nil {
+		return 0, e
+	}
+	if e := ob.f.Sync(); e != nil {
+		return 0, e
+	}
+	ob.nextSeq++
+	ob.pending[seq] = payload
+	return seq, nil
+}
+
+func (ob *Outbox) Ack(seq uint64) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if _, ok := ob.pending[seq]; !ok {
+		return nil
+	}
+	if e := ob.append(kindAck, seq, nil); e != nil {
+		return e
+	}
+	delete(ob.pending, seq)
+
+	if len(ob.pending) == 0 && ob.size > CompactSize {
+		if e := ob.f.Truncate(0); e != nil {
+			return e
+		}
+		ob.size = 0
+	}
+	return nil
+}
+
+// returns not acked records from older to newer
+func (ob *Outbox) Pending() []Entry {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return ob.pendingLocked()
+}
+
+func (ob *Outbox) pendingLocked() []Entry {
+	entries := make([]Entry, 0, len(ob.pending))
+	for seq, payload := range ob.pending {
+		entries = append(entries, Entry{Seq: seq, Payload: payload})
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	return entries
+}
+
+func (ob *Outbox) Len() int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.pending)
+}
+
+// files are removed while lock is held, so an instance opening dir meanwhile starts with empty outbox
+func (ob *Outbox) remove() error {
+	for _, p := range []string{ob.path, filepath.Join(filepath.Dir(ob.path), lockName)} {
+		if e := os.Remove(p); e != nil && !errors.Is(e, os.ErrNotExist) {
+			ob.Close()
+			return e
+		}
+	}
+	if e := ob.Close(); e != nil {
+		return e
+	}
+	os.Remove(filepath.Dir(ob.path)) // dir is kept if somebody started using it
+	return nil
+}
+
+func (ob *Outbox) Close() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.f == nil {
+		return nil
+	}
+	e := ob.f.Sync()
+	if ce := ob.f.Close(); e == nil {
+		e = ce
+	}
+	ob.lock.Close()
+	ob.f = nil
+	return e
+}
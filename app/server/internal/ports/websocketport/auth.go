@@ -0,0 +1,105 @@
+package websocketport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"server/external/account"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var ErrorNoToken error = errors.New("token is required, pass it as bearer authorization header or token query param")
+
+type authResponse struct {
+	Token string       `json:"token"`
+	User  account.User `json:"user"`
+}
+
+// browsers can't set headers on websocket upgrade, so token query param is accepted too
+func parseToken(r *http.Request) (string, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok {
+			return "", ErrorNoToken
+		}
+		return token, nil
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, nil
+	}
+	return "", ErrorNoToken
+}
+
+func (s *server) authenticate(r *http.Request) (account.User, error) {
+	token, e := parseToken(r)
+	if e != nil {
+		return account.User{}, e
+	}
+	return s.issuer.Verify(token)
+}
+
+func authErrStatus(e error) int {
+	switch e {
+	case account.ErrorInvalidName, account.ErrorInvalidPassword:
+		return http.StatusBadRequest
+	case account.ErrorUserExists:
+		return http.StatusConflict
+	case account.ErrorWrongCredentials:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	s.credentialsHandler(w, r, s.accounts.Register)
+}
+
+func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	s.credentialsHandler(w, r, s.accounts.Login)
+}
+
+// takes name and password from post form and answers with signed token for the user
+func (s *server) credentialsHandler(w http.ResponseWriter, r *http.Request, check func(string, string) (account.User, error)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if e := r.ParseForm(); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(e.Error()))
+		return
+	}
+	name, password := r.PostForm.Get("name"), r.PostForm.Get("password")
+	e := account.ValidateCredentials(name, password)
+	var u account.User
+	if e == nil {
+		u, e = check(name, password)
+	}
+	if e != nil {
+		s.lg.Warn("Failed to check user credentials", zap.Error(e), zap.String("path", r.URL.Path))
+		status := authErrStatus(e)
+		w.WriteHeader(status)
+		if status != http.StatusInternalServerError {
+			w.Write([]byte(e.Error()))
+		}
+		return
+	}
+
+	token, e := s.issuer.Issue(u)
+	if e != nil {
+		s.lg.Error("Failed to issue token", zap.Error(e), zap.Int("user id", u.Id))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf, e := json.Marshal(authResponse{Token: token, User: u})
+	if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -18,78 +18,112 @@ var ErrorFailedToWriteMsgToRepo error = errors.New("server failed to write messa
 var ErrorFailedToEncodeMsg error = errors.New("server failed to encode message from repo to buffer")
 
 func (s server) writeLastMessagesToNewbie(conn *websocket.Conn, amt int) {
+	cl := s.getClient(conn)
 	s.eg.Go(func() error {
-		msgs, e := s.repo.GetLastKMessages(amt)
+		msgs, e := s.repo.GetLastKMessages(cl.cId, amt)
 		if e != nil {
-			s.lg.Error("Failed to get last k messages for newbie", zap.Error(e), zap.Int("user id", s.clients[conn]))
-			return ErrorRepoFailedToReadMsg
+			s.lg.Error("Failed to get last k messages for newbie", zap.Error(e), zap.Int("user id", cl.uId), zap.Int("chat id", cl.cId))
+			s.writeFrame(conn, cl, message.NewErrFrame(message.ErrCodeInternal, ErrorRepoFailedToReadMsg.Error()))
+			return nil // newbie gets next messages anyway, other chats must not be stopped by its failure
 		}
+		msgs = s.syncNewbieMessages(cl.cId, 0, msgs)
 
-		bufs, _, e := s.prepareMsgsToSend(msgs)
-		if e != nil {
-			s.lg.Error("Failed to prepare messages for newbie", zap.Error(e), zap.Int("user id", s.clients[conn]))
-			return ErrorFailedToEncodeMsg
-		}
-		for _, buf := range bufs {
+		for _, msg := range msgs {
 			select {
 			case <-s.ctx.Done():
 				return nil
 			default:
 			}
 
-			if e := conn.WriteMessage(websocket.TextMessage, buf); e != nil {
-				s.lg.Error("Failed to write message to websocket connection", zap.Error(e), zap.Int("user id", s.clients[conn]))
-				return ErrorFailedToWriteMsg
+			if e := s.writeFrame(conn, cl, message.NewMsgFrame(msg)); e != nil {
+				return nil // newbie has already gone
 			}
 		}
 		return nil
 	})
 }
 
-func (s server) prepareMsgsToSend(msgs []message.Message) ([][]byte, []int, error) {
-	toReturnBufs := make([][]byte, len(msgs))
-	toReturnIds := make([]int, len(msgs))
+// replays messages after lMsgId page by page till it reaches the ones which are broadcasted to chat anyway
+func (s server) writeMissedMessages(conn *websocket.Conn, lMsgId int64) {
+	cl := s.getClient(conn)
+	s.eg.Go(func() error {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
+
+			msgs, e := s.repo.GetNewerMessages(cl.cId, lMsgId)
+			if e != nil {
+				s.lg.Error("Failed to get missed messages for reconnected client", zap.Error(e), zap.Int("user id", cl.uId), zap.Int("chat id", cl.cId), zap.Int64("last message id", lMsgId))
+				s.writeFrame(conn, cl, message.NewErrFrame(message.ErrCodeInternal, ErrorRepoFailedToReadMsg.Error()))
+				return nil
+			}
+			toSend := s.syncNewbieMessages(cl.cId, lMsgId, msgs)
 
-	for i, msg := range msgs {
-		var e error
-		toReturnBufs[i], e = message.EncodeMsgsToBytes(msg)
-		if e != nil {
-			s.lg.Error("Failed to encode message from repo", zap.Error(e))
-			return [][]byte{}, []int{}, ErrorFailedToEncodeMsg
+			for _, msg := range toSend {
+				if e = s.writeFrame(conn, cl, message.NewMsgFrame(msg)); e != nil {
+					return nil // client has already gone
+				}
+				lMsgId = max(lMsgId, msg.GetId())
+			}
+			if len(msgs) == 0 || len(toSend) < len(msgs) {
+				return nil
+			}
 		}
-		toReturnIds[i] = msg.GetUserId()
-	}
+	})
+}
 
-	return toReturnBufs, toReturnIds, nil
+func (s server) writeFrame(conn *websocket.Conn, cl client, f message.Frame) error {
+	buf, e := cl.codec.EncodeFrame(f)
+	if errors.Is(e, message.ErrorNotInLegacyProtocol) {
+		return nil // legacy client gets only messages
+	}
+	if e != nil {
+		s.lg.Error("Failed to encode frame", zap.Error(e), zap.Int("user id", cl.uId), zap.String("subprotocol", cl.codec.Subprotocol()))
+		return ErrorFailedToEncodeMsg
+	}
+	if e = cl.out.push(buf); e != nil {
+		s.lg.Warn("Failed to queue frame to websocket connection", zap.Error(e), zap.Int("user id", cl.uId))
+		return ErrorFailedToWriteMsg
+	}
+	return nil
 }
 
+// messages pushed by notifier are broadcasted at once, polling catches up what was missed,
+// failure of one chat is retried by the next poll and doesn't stop broadcasting to the others
 func (s server) waitForMessages() {
 	s.eg.Go(func() error {
-		ticker := time.NewTicker(100 * time.Millisecond)
+		var notes <-chan message.Message
+		if s.notifier != nil {
+			notes = s.notifier.Notifications()
+		}
+		interval := PollInterval
+		if notes != nil {
+			interval = CatchUpInterval
+		}
+
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-s.ctx.Done():
 				return nil
-			case <-ticker.C:
-				msgs, e := s.repo.GetNewerMessages()
-				if len(msgs) == 0 {
-					s.lg.Debug("No new messages received")
+			case msg, ok := <-notes:
+				if !ok {
+					s.lg.Warn("Notifications stopped, fall back to polling")
+					notes = nil
+					ticker.Reset(PollInterval)
 					continue
 				}
-				if e != nil {
-					s.lg.Error("Failed to get message from repo", zap.Error(e))
-					return ErrorRepoFailedToReadMsg
+				if e := s.broadcastNotifiedMessage(msg); e != nil {
+					s.lg.Warn("Failed to broadcast notified message, it is polled later", zap.Error(e), zap.Int("chat id", msg.GetChatId()))
 				}
-
-				bufs, uIds, e := s.prepareMsgsToSend(msgs)
-				if e != nil {
-					return e
-				}
-
-				for i, buf := range bufs {
-					if e = s.writeMessage(buf, uIds[i]); e != nil {
-						return e
+			case <-ticker.C:
+				for _, cId := range s.getActiveChats() {
+					if e := s.broadcastNewMessages(cId); e != nil {
+						s.lg.Warn("Failed to broadcast new messages, retry on next poll", zap.Error(e), zap.Int("chat id", cId))
 					}
 				}
 			}
@@ -97,34 +131,100 @@ func (s server) waitForMessages() {
 	})
 }
 
-func (s server) writeMessage(buf []byte, maId int) (errReturn error) {
-	s.lg.Info("Send message to clients", zap.Int("author user id", maId), zap.Int("message buf len", len(buf)))
-	for conn, uId := range s.clients {
-		if uId == maId {
+// message is sent only if it directly follows the last broadcasted one, otherwise the gap is polled from repo
+func (s server) broadcastNotifiedMessage(msg message.Message) error {
+	cId := msg.GetChatId()
+	lMsgId, ok := s.getLastMsgId(cId)
+	if !ok || msg.GetId() <= lMsgId {
+		return nil
+	}
+	if msg.GetId() > lMsgId+1 {
+		s.lg.Debug("Notified message is ahead of broadcasted ones, catch up", zap.Int("chat id", cId), zap.Int64("message id", msg.GetId()), zap.Int64("last message id", lMsgId))
+		return s.broadcastNewMessages(cId)
+	}
+
+	s.updateLastMsgId(cId, []message.Message{msg})
+	return s.writeMessage(msg, cId)
+}
+
+func (s server) broadcastNewMessages(cId int) error {
+	lMsgId, _ := s.getLastMsgId(cId)
+	msgs, e := s.repo.GetNewerMessages(cId, lMsgId)
+	if e != nil {
+		s.lg.Error("Failed to get message from repo", zap.Error(e), zap.Int("chat id", cId))
+		return ErrorRepoFailedToReadMsg
+	}
+	if len(msgs) == 0 {
+		s.lg.Debug("No new messages received", zap.Int("chat id", cId))
+		return nil
+	}
+	s.updateLastMsgId(cId, msgs)
+
+	for _, msg := range msgs {
+		if e = s.writeMessage(msg, cId); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// message is encoded once for every subprotocol used in chat, connection which sent it gets persisted ack instead of message,
+// other connections of the author get message as everyone else,
+// clients which failed to get it are not an error of the broadcast
+func (s server) writeMessage(msg message.Message, cId int) error {
+	s.lg.Info("Send message to clients", zap.Int("author user id", msg.GetUserId()), zap.Int("chat id", cId), zap.Int64("message id", msg.GetId()))
+	bufs := make(map[string][]byte)
+	for conn, cl := range s.getChatConns(cId) {
+		if cl.uId == msg.GetUserId() && cl.pending.take(msg.GetClientId()) {
+			s.writeFrame(conn, cl, message.NewAckFrame(msg.GetClientId(), message.AckStatusPersisted, msg.GetId()))
 			continue
 		}
 
-		if e := conn.WriteMessage(websocket.TextMessage, buf); e != nil {
-			s.lg.Warn("Failed to write message to websocket connection", zap.Error(e), zap.Int("user id", uId))
-			errReturn = ErrorFailedToWriteMsg
+		buf, ok := bufs[cl.codec.Subprotocol()]
+		if !ok {
+			var e error
+			if buf, e = cl.codec.EncodeFrame(message.NewMsgFrame(msg)); e != nil {
+				s.lg.Error("Failed to encode message from repo", zap.Error(e), zap.String("subprotocol", cl.codec.Subprotocol()))
+				return ErrorFailedToEncodeMsg
+			}
+			bufs[cl.codec.Subprotocol()] = buf
+		}
+
+		if e := cl.out.push(buf); e != nil {
+			s.lg.Warn("Failed to queue message to websocket connection", zap.Error(e), zap.Int("user id", cl.uId))
 		}
 	}
-	return
+	return nil
 }
 
 func (s server) closeConns() { // I know that I will close conns twice, but it is for more secure
 	s.lg.Info("Close connections with clients")
-	for conn, uId := range s.clients {
-		if e := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Server is shut down")); e != nil {
-			s.lg.Warn("Failed to write close message to websocket connection", zap.Error(e), zap.Int("user id", uId))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, cl := range s.clients {
+		cl.out.close()
+		if e := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shut down"), time.Now().Add(WriteWait)); e != nil {
+			s.lg.Warn("Failed to write close message to websocket connection", zap.Error(e), zap.Int("user id", cl.uId))
 		}
 		if e := conn.Close(); e != nil {
-			s.lg.Warn("Failed to close websocket connection", zap.Error(e), zap.Int("user id", uId))
+			s.lg.Warn("Failed to close websocket connection", zap.Error(e), zap.Int("user id", cl.uId))
 		}
 	}
 }
 
+func decodeErrCode(e error) string {
+	switch {
+	case errors.Is(e, message.ErrorUnsupportedVersion):
+		return message.ErrCodeUnsupportedVersion
+	case errors.Is(e, message.ErrorUnknownEnvelopeType):
+		return message.ErrCodeUnknownType
+	default:
+		return message.ErrCodeBadFrame
+	}
+}
+
 func (s *server) recieveMessages(conn *websocket.Conn) error {
+	cl := s.getClient(conn)
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -132,32 +232,85 @@ func (s *server) recieveMessages(conn *websocket.Conn) error {
 		default:
 		}
 		mt, buf, e := conn.ReadMessage()
-		s.lg.Info("Got message from client", zap.Int("user id", s.clients[conn]), zap.Int("message buf len", len(buf)), zap.Int("message type", mt), zap.Error(e))
+		s.lg.Info("Got message from client", zap.Int("user id", cl.uId), zap.Int("message buf len", len(buf)), zap.Int("message type", mt), zap.Error(e))
 
+		if isTimeout(e) {
+			return ErrorClientTimedOut
+		}
 		if e != nil && websocket.IsUnexpectedCloseError(e, websocket.CloseNormalClosure) { // CloseGoingAway?
 			s.lg.Warn("Failed to read message from conn", zap.Error(e))
 			return ErrorServerFailedToReadMsg
 		}
 		if mt == websocket.CloseMessage || mt == -1 { // now I can't really explain why server got -1 not 8 - TODO check it
-			s.lg.Info("Client closed connection with a server as he wished", zap.Int("user id", s.clients[conn]))
+			s.lg.Info("Client closed connection with a server as he wished", zap.Int("user id", cl.uId))
 			return ErrorClosedConnection
 		}
 		if mt != websocket.TextMessage {
-			s.lg.Warn("Server got unexpected message type", zap.Int("message type", mt), zap.Int("user id", s.clients[conn]))
+			s.lg.Warn("Server got unexpected message type", zap.Int("message type", mt), zap.Int("user id", cl.uId))
 			continue
 		}
 
-		msg, e := message.DecodeMsgFromBytes(buf)
+		f, e := cl.codec.DecodeFrame(buf)
 		if e != nil {
-			s.lg.Warn("Unable to decode received message", zap.Error(e), zap.Int("user id", s.clients[conn]))
-			return ErrorFailedToParseMsg
+			s.lg.Warn("Unable to decode received message", zap.Error(e), zap.Int("user id", cl.uId))
+			if e = s.writeFrame(conn, cl, message.NewErrFrame(decodeErrCode(e), e.Error())); e != nil {
+				return e
+			}
+			continue
 		}
-		s.lg.Warn("!!!!!!", zap.Any("USER ID ", s.clients[conn]))
-		msg.SetUserId(s.clients[conn])
-		msg.SetChatId(0) // now only one chat for developing
-		if e = s.repo.AddMessage(msg); e != nil {
-			s.lg.Warn("Failed to send message to client", zap.Error(e), zap.Int("user id", s.clients[conn]))
-			return ErrorFailedToWriteMsgToRepo
+
+		switch {
+		case f.Msg != nil:
+			msg := *f.Msg
+			msg.SetUserId(cl.uId)
+			msg.User = cl.name
+			msg.SetChatId(cl.cId)
+			cl.pending.add(msg.GetClientId())
+			if e = s.repo.AddMessage(&msg, s.ackAccepted(conn, cl, msg.GetClientId())); e != nil {
+				cl.pending.take(msg.GetClientId())
+				s.lg.Warn("Failed to send message to client", zap.Error(e), zap.Int("user id", cl.uId))
+				s.writeFrame(conn, cl, message.NewMsgErrFrame(message.ErrCodeInternal, ErrorFailedToWriteMsgToRepo.Error(), msg.GetClientId()))
+				return ErrorFailedToWriteMsgToRepo
+			}
+		case f.HistReq != nil:
+			if e = s.writeHistory(conn, cl, *f.HistReq); e != nil {
+				return e
+			}
+		default:
+			s.lg.Warn("Got unexpected frame from client", zap.Int("user id", cl.uId))
+			if e = s.writeFrame(conn, cl, message.NewErrFrame(message.ErrCodeUnknownType, "server accepts only messages and history requests")); e != nil {
+				return e
+			}
+		}
+	}
+}
+
+// returns callback answering the sender once repo accepted its message
+func (s *server) ackAccepted(conn *websocket.Conn, cl client, clId string) func(error) {
+	return func(e error) {
+		f := message.NewAckFrame(clId, message.AckStatusAccepted, 0)
+		if e != nil {
+			s.lg.Warn("Message was not delivered to repo", zap.Error(e), zap.Int("user id", cl.uId), zap.String("client id", clId))
+			cl.pending.take(clId)
+			f = message.NewMsgErrFrame(message.ErrCodeNotDelivered, e.Error(), clId)
+		}
+		s.writeFrame(conn, cl, f) // sender may be already gone, writeFrame logs it
+	}
+}
+
+func (s *server) writeHistory(conn *websocket.Conn, cl client, req message.HistoryRequest) error {
+	amt := min(max(req.Amount, 0), MaxHistoryPageAmt)
+	msgs, e := s.repo.GetOlderMessages(cl.cId, req.BeforeId, amt)
+	if e != nil {
+		s.lg.Error("Failed to get history messages", zap.Error(e), zap.Int("user id", cl.uId), zap.Int("chat id", cl.cId), zap.Int64("before message id", req.BeforeId))
+		return s.writeFrame(conn, cl, message.NewErrFrame(message.ErrCodeInternal, ErrorRepoFailedToReadMsg.Error())) // client can ask again, no reason to drop connection
+	}
+
+	nbMsgId := req.BeforeId
+	for _, msg := range msgs {
+		if nbMsgId <= 0 || msg.GetId() < nbMsgId {
+			nbMsgId = msg.GetId()
 		}
 	}
+	return s.writeFrame(conn, cl, message.NewHistRespFrame(msgs, nbMsgId))
 }
@@ -2,11 +2,14 @@ package websocketport
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"server/external/adapters"
+	"server/external/auth"
+	"server/external/message"
+	"strconv"
 	"sync"
-
-	"math/rand"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
@@ -14,23 +17,121 @@ import (
 )
 
 const MaxLastMsgsAmt = 10
+const MaxHistoryPageAmt = 50
+
+const PollInterval = 100 * time.Millisecond
+const CatchUpInterval = 5 * time.Second // polling is only a fallback while repo pushes messages
+
+var ErrorInvalidChatId error = errors.New("chat id must be a non negative integer")
+var ErrorInvalidLastMsgId error = errors.New("last message id must be a non negative integer")
+
+type client struct {
+	uId     int    // account id, one user may be connected to chat several times
+	name    string // taken from token, so clients can't impersonate each other
+	cId     int
+	codec   message.FrameCodec // chosen by subprotocol negotiated on upgrade
+	out     *sendQueue         // websocket conn doesn't support concurrent writers, so every frame goes through it
+	pending *pendingAcks       // client ids of messages sent by this connection, only it gets persisted acks for them
+}
+
+type pendingAcks struct {
+	ids map[string]struct{}
+	mu  *sync.Mutex
+}
+
+func newPendingAcks() *pendingAcks {
+	return &pendingAcks{ids: make(map[string]struct{}), mu: &sync.Mutex{}}
+}
+
+func (pa *pendingAcks) add(clId string) {
+	if clId == "" { // nothing to answer with ack, so author will get message itself
+		return
+	}
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	pa.ids[clId] = struct{}{}
+}
+
+// returns true if client id was sent by this connection and is not acked yet
+func (pa *pendingAcks) take(clId string) bool {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	_, ok := pa.ids[clId]
+	delete(pa.ids, clId)
+	return ok
+}
 
 type server struct {
-	clients   map[*websocket.Conn]int
-	repo      adapters.Repository
-	lastMsgId int
-	lg        *zap.Logger
-	ctx       context.Context
-	eg        *errgroup.Group
-	mu        *sync.Mutex
+	clients    map[*websocket.Conn]client
+	repo       adapters.Repository
+	notifier   adapters.Notifier
+	presence   adapters.Presence
+	accounts   adapters.Accounts
+	issuer     *auth.Issuer
+	queueCfg   SendQueueConfig
+	hbCfg      HeartbeatConfig
+	lastMsgIds map[int]int64 // id of the last message broadcasted to chat
+	lg         *zap.Logger
+	ctx        context.Context
+	eg         *errgroup.Group
+	mu         *sync.Mutex
+}
+
+func newServer(ctx context.Context, eg *errgroup.Group, repo adapters.Repository, notifier adapters.Notifier, presence adapters.Presence, accounts adapters.Accounts, issuer *auth.Issuer, queueCfg SendQueueConfig, hbCfg HeartbeatConfig, lg *zap.Logger, mu *sync.Mutex) server {
+	return server{clients: make(map[*websocket.Conn]client), repo: repo, notifier: notifier, presence: presence, accounts: accounts, issuer: issuer, queueCfg: queueCfg, hbCfg: hbCfg, lastMsgIds: make(map[int]int64), lg: lg, ctx: ctx, eg: eg, mu: mu}
+}
+
+// chat to join is taken from chat_id query param, chat 0 is used if it is absent
+func parseChatId(r *http.Request) (int, error) {
+	qCId := r.URL.Query().Get("chat_id")
+	if qCId == "" {
+		return 0, nil
+	}
+	cId, e := strconv.Atoi(qCId)
+	if e != nil || cId < 0 {
+		return 0, ErrorInvalidChatId
+	}
+	return cId, nil
 }
 
-func newServer(ctx context.Context, eg *errgroup.Group, repo adapters.Repository, lg *zap.Logger, mu *sync.Mutex) server {
-	return server{clients: make(map[*websocket.Conn]int), repo: repo, lastMsgId: -1, lg: lg, ctx: ctx, eg: eg, mu: mu}
+// reconnecting client passes id of the last message it saw as last_message_id query param, ok is false for new clients
+func parseLastMsgId(r *http.Request) (int64, bool, error) {
+	qLMsgId := r.URL.Query().Get("last_message_id")
+	if qLMsgId == "" {
+		return 0, false, nil
+	}
+	lMsgId, e := strconv.ParseInt(qLMsgId, 10, 64)
+	if e != nil || lMsgId < 0 {
+		return 0, false, ErrorInvalidLastMsgId
+	}
+	return lMsgId, true, nil
 }
 
 func (s *server) chatHandler(w http.ResponseWriter, r *http.Request) {
-	s.lg.Info("Got new websocket connection")
+	cId, e := parseChatId(r)
+	if e != nil {
+		s.lg.Warn("Failed to parse chat id", zap.Error(e), zap.String("chat id", r.URL.Query().Get("chat_id")))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(e.Error()))
+		return
+	}
+	lMsgId, resumed, e := parseLastMsgId(r)
+	if e != nil {
+		s.lg.Warn("Failed to parse last message id", zap.Error(e), zap.String("last message id", r.URL.Query().Get("last_message_id")))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(e.Error()))
+		return
+	}
+
+	u, e := s.authenticate(r)
+	if e != nil {
+		s.lg.Warn("Rejected unauthenticated connection", zap.Error(e))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(e.Error()))
+		return
+	}
+
+	s.lg.Info("Got new websocket connection", zap.Int("chat id", cId), zap.Int("user id", u.Id))
 	conn, e := upgrader.Upgrade(w, r, nil)
 	if e != nil {
 		s.lg.Error("Failed to upgrade new connection", zap.Error(e))
@@ -38,14 +139,32 @@ func (s *server) chatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	s.lg.Info("Websocket connection upgraded", zap.String("subprotocol", conn.Subprotocol()))
+
+	startHeartbeat(conn, s.hbCfg)
+	out := newSendQueue(conn, s.queueCfg)
+	s.eg.Go(func() error {
+		out.run(s.hbCfg.PingInterval, s.lg.With(zap.Int("user id", u.Id)))
+		return nil
+	})
 
 	s.mu.Lock()
-	s.clients[conn] = int(rand.Int31())
+	s.clients[conn] = client{uId: u.Id, name: u.Name, cId: cId, codec: message.NewServerCodec(conn.Subprotocol()), out: out, pending: newPendingAcks()}
 	s.mu.Unlock()
-	defer delete(s.clients, conn)
+	s.joinPresence(s.getClient(conn))
+	defer s.removeClient(conn)
 
-	s.writeLastMessagesToNewbie(conn, MaxLastMsgsAmt)
+	if resumed {
+		s.writeMissedMessages(conn, lMsgId)
+	} else {
+		s.writeLastMessagesToNewbie(conn, MaxLastMsgsAmt)
+	}
 	e = s.recieveMessages(conn)
+	if e == ErrorClientTimedOut {
+		reapedConns.Add(1)
+		s.lg.Info("Evicted unresponsive client", zap.Int("user id", u.Id))
+		return
+	}
 	if e != nil && e != ErrorClosedConnection {
 		s.lg.Error("Failed to recive messages", zap.Error(e))
 		if e != ErrorServerFailedToReadMsg {
@@ -54,10 +173,110 @@ func (s *server) chatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.lg.Info("End handler", zap.Int("user id", s.clients[conn]))
+	s.lg.Info("End handler", zap.Int("user id", s.getClient(conn).uId))
+}
+
+func (s *server) getClient(conn *websocket.Conn) client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[conn]
+}
+
+func (s *server) removeClient(conn *websocket.Conn) {
+	s.mu.Lock()
+	cl := s.clients[conn]
+	cl.out.close()
+	delete(s.clients, conn)
+	chatActive, userActive := false, false
+	for _, other := range s.clients {
+		if other.cId == cl.cId {
+			chatActive = true
+			userActive = userActive || other.uId == cl.uId
+		}
+	}
+	if !chatActive {
+		delete(s.lastMsgIds, cl.cId) // nobody waits for messages from chat, so next newbie will start it again
+	}
+	s.mu.Unlock()
+
+	if !userActive { // user is still online in chat through another connection
+		s.leavePresence(cl) // presence goes to redis, so it is not called under lock blocking every other client
+	}
+}
+
+// returns chats with at least one connected client and already known last message id
+func (s *server) getActiveChats() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[int]struct{})
+	cIds := make([]int, 0)
+	for _, cl := range s.clients {
+		if _, ok := s.lastMsgIds[cl.cId]; !ok {
+			continue
+		}
+		if _, ok := seen[cl.cId]; !ok {
+			seen[cl.cId] = struct{}{}
+			cIds = append(cIds, cl.cId)
+		}
+	}
+	return cIds
+}
+
+// ok is false if chat is not broadcasted now
+func (s *server) getLastMsgId(cId int) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lMsgId, ok := s.lastMsgIds[cId]
+	return lMsgId, ok
+}
+
+func (s *server) updateLastMsgId(cId int, msgs []message.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.lastMsgIds[cId] = max(s.lastMsgIds[cId], msg.GetId())
+	}
+}
+
+// starts broadcasting chat from the newest of msgs (but not before fromId) if it is not broadcasted yet,
+// otherwise drops msgs which will be broadcasted later not to send them twice
+func (s *server) syncNewbieMessages(cId int, fromId int64, msgs []message.Message) []message.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lMsgId, ok := s.lastMsgIds[cId]
+	if !ok {
+		lMsgId = fromId
+		for _, msg := range msgs {
+			lMsgId = max(lMsgId, msg.GetId())
+		}
+		s.lastMsgIds[cId] = lMsgId
+		return msgs
+	}
+
+	toSend := make([]message.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.GetId() <= lMsgId {
+			toSend = append(toSend, msg)
+		}
+	}
+	return toSend
+}
+
+// returns connections of clients from the chat, so writing to them doesn't need server lock
+func (s *server) getChatConns(cId int) map[*websocket.Conn]client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make(map[*websocket.Conn]client)
+	for conn, cl := range s.clients {
+		if cl.cId == cId {
+			conns[conn] = cl
+		}
+	}
+	return conns
 }
 
 var upgrader = websocket.Upgrader{
+	Subprotocols: []string{message.JsonSubprotocol, message.GobSubprotocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -0,0 +1,42 @@
+package websocketport
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrorInvalidHeartbeat error = errors.New("ping interval must be positive and less than pong wait")
+var ErrorClientTimedOut error = errors.New("client didn't answer pings in time")
+
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongWait     time.Duration // connection is evicted if nothing comes from client for that long
+}
+
+var DefaultHeartbeatConfig = HeartbeatConfig{PingInterval: 20 * time.Second, PongWait: 30 * time.Second}
+
+func (c HeartbeatConfig) Validate() error {
+	if c.PingInterval <= 0 || c.PingInterval >= c.PongWait {
+		return ErrorInvalidHeartbeat
+	}
+	return nil
+}
+
+var reapedConns = expvar.NewInt("websocket_reaped_connections")
+
+// pings themselves are sent by the connection writer, reader only waits for pongs
+func startHeartbeat(conn *websocket.Conn, cfg HeartbeatConfig) {
+	conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	})
+}
+
+func isTimeout(e error) bool {
+	var ne net.Error
+	return errors.As(e, &ne) && ne.Timeout()
+}
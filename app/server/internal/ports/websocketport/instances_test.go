@@ -0,0 +1,254 @@
+package websocketport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/external/account"
+	"server/external/auth"
+	"server/external/message"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const CollectTime = time.Second
+
+// storage shared by instances, every stored message is pushed to every subscribed instance like kafka does for their groups
+type fakeStore struct {
+	msgs   []message.Message
+	subs   map[chan message.Message]struct{}
+	mu     *sync.Mutex
+	issuer *auth.Issuer
+}
+
+func newFakeStore(t *testing.T) *fakeStore {
+	issuer, err := auth.NewIssuer("secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeStore{subs: make(map[chan message.Message]struct{}), mu: &sync.Mutex{}, issuer: issuer}
+}
+
+func (fs *fakeStore) subscribe() chan message.Message {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ch := make(chan message.Message, 64)
+	fs.subs[ch] = struct{}{}
+	return ch
+}
+
+func (fs *fakeStore) unsubscribe(ch chan message.Message) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.subs, ch)
+	close(ch)
+}
+
+func (fs *fakeStore) AddMessage(m *message.Message, onStored func(error)) error {
+	msg := *m
+	go func() {
+		fs.mu.Lock()
+		msg.SetId(int64(len(fs.msgs) + 1))
+		fs.msgs = append(fs.msgs, msg)
+		for ch := range fs.subs {
+			ch <- msg
+		}
+		fs.mu.Unlock()
+		onStored(nil)
+	}()
+	return nil
+}
+
+func (fs *fakeStore) GetNewerMessages(cId int, lMsgId int64) ([]message.Message, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	msgs := make([]message.Message, 0)
+	for _, msg := range fs.msgs {
+		if msg.GetChatId() == cId && msg.GetId() > lMsgId {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (fs *fakeStore) GetLastKMessages(cId int, k int) ([]message.Message, error) {
+	return fs.GetOlderMessages(cId, 0, k)
+}
+
+func (fs *fakeStore) GetOlderMessages(cId int, bMsgId int64, k int) ([]message.Message, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	msgs := make([]message.Message, 0)
+	for i := len(fs.msgs) - 1; i >= 0 && len(msgs) < k; i-- {
+		if msg := fs.msgs[i]; msg.GetChatId() == cId && (bMsgId <= 0 || msg.GetId() < bMsgId) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (fs *fakeStore) CloseRepo() error {
+	return nil
+}
+
+type fakePresence struct{}
+
+func (fakePresence) Join(int, int) error          { return nil }
+func (fakePresence) Leave(int, int) error         { return nil }
+func (fakePresence) Refresh(int, []int) error     { return nil }
+func (fakePresence) CountOnline(int) (int, error) { return 0, nil }
+func (fakePresence) ClosePresence() error         { return nil }
+
+type chanNotifier chan message.Message
+
+func (cn chanNotifier) Notifications() <-chan message.Message {
+	return cn
+}
+
+type testInstance struct {
+	s     *server
+	ts    *httptest.Server
+	notes chan message.Message
+	cncl  context.CancelFunc
+}
+
+func startInstance(t *testing.T, fs *fakeStore) *testInstance {
+	ctx, cncl := context.WithCancel(context.Background())
+	eg, ctx := errgroup.WithContext(ctx)
+	notes := fs.subscribe()
+	s := newServer(ctx, eg, fs, chanNotifier(notes), fakePresence{}, nil, fs.issuer, DefaultSendQueueConfig, DefaultHeartbeatConfig, zap.NewNop(), &sync.Mutex{})
+	s.waitForMessages()
+	inst := &testInstance{s: &s, ts: httptest.NewServer(http.HandlerFunc(s.chatHandler)), notes: notes, cncl: cncl}
+	t.Cleanup(func() { inst.stop(fs) })
+	return inst
+}
+
+func (inst *testInstance) stop(fs *fakeStore) {
+	if inst.cncl == nil {
+		return
+	}
+	inst.cncl()
+	inst.s.closeConns()
+	inst.ts.Close()
+	fs.unsubscribe(inst.notes)
+	inst.cncl = nil
+}
+
+type testClient struct {
+	conn   *websocket.Conn
+	codec  message.FrameCodec
+	frames chan message.Frame
+}
+
+func dial(t *testing.T, fs *fakeStore, inst *testInstance, u account.User, query string) *testClient {
+	token, err := fs.issuer.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := strings.Replace(inst.ts.URL, "http", "ws", 1) + "/?chat_id=1&token=" + token + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cl := &testClient{conn: conn, codec: message.NewClientCodec(conn.Subprotocol()), frames: make(chan message.Frame, 64)}
+	go func() {
+		defer close(cl.frames)
+		for {
+			_, buf, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if f, err := cl.codec.DecodeFrame(buf); err == nil {
+				cl.frames <- f
+			}
+		}
+	}()
+	return cl
+}
+
+func (cl *testClient) send(t *testing.T, text string) {
+	buf, err := cl.codec.EncodeFrame(message.NewMsgFrame(message.Message{Text: text, ClientId: text}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cl.conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns sorted texts of messages got till d passes or connection is closed
+func (cl *testClient) collect(d time.Duration) []string {
+	texts := make([]string, 0)
+	deadline := time.After(d)
+	for {
+		select {
+		case f, ok := <-cl.frames:
+			if !ok {
+				sort.Strings(texts)
+				return texts
+			}
+			if f.Msg != nil {
+				texts = append(texts, f.Msg.Text)
+			}
+		case <-deadline:
+			sort.Strings(texts)
+			return texts
+		}
+	}
+}
+
+func checkTexts(t *testing.T, who string, got []string, want ...string) {
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s got %q, want %q once each", who, got, want)
+	}
+}
+
+func TestInstancesDeliverEveryMessageOnceToTheirClients(t *testing.T) {
+	fs := newFakeStore(t)
+	a, b := startInstance(t, fs), startInstance(t, fs)
+	alice := dial(t, fs, a, account.NewUser(1, "alice"), "")
+	bob := dial(t, fs, b, account.NewUser(2, "bob"), "")
+	carol := dial(t, fs, b, account.NewUser(3, "carol"), "")
+	time.Sleep(100 * time.Millisecond) // newbies start chat cursors
+
+	alice.send(t, "hi")
+	alice.send(t, "there")
+	bob.send(t, "yo")
+
+	checkTexts(t, "alice", alice.collect(CollectTime), "yo") // authors get acks instead of their messages
+	checkTexts(t, "bob", bob.collect(CollectTime), "hi", "there")
+	checkTexts(t, "carol", carol.collect(CollectTime), "hi", "there", "yo")
+}
+
+func TestClientOfRestartedInstanceGetsMissedMessagesOnce(t *testing.T) {
+	fs := newFakeStore(t)
+	a, b := startInstance(t, fs), startInstance(t, fs)
+	alice := dial(t, fs, a, account.NewUser(1, "alice"), "")
+	bob := dial(t, fs, b, account.NewUser(2, "bob"), "")
+	time.Sleep(100 * time.Millisecond)
+
+	alice.send(t, "before restart")
+	checkTexts(t, "bob", bob.collect(CollectTime), "before restart")
+
+	b.stop(fs)
+	alice.send(t, "while restarting")
+	time.Sleep(100 * time.Millisecond)
+
+	b = startInstance(t, fs)
+	bob = dial(t, fs, b, account.NewUser(2, "bob"), "&last_message_id=1")
+	alice.send(t, "after restart")
+	checkTexts(t, "bob", bob.collect(CollectTime), "while restarting", "after restart")
+	checkTexts(t, "alice", alice.collect(CollectTime))
+}
@@ -0,0 +1,81 @@
+package websocketport
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const PresenceRefreshInterval = 10 * time.Second // must be less than presence ttl
+
+type presenceResponse struct {
+	ChatId int `json:"chat_id"`
+	Online int `json:"online"`
+}
+
+func (s *server) joinPresence(cl client) {
+	if e := s.presence.Join(cl.cId, cl.uId); e != nil {
+		s.lg.Warn("Failed to join chat presence", zap.Error(e), zap.Int("user id", cl.uId), zap.Int("chat id", cl.cId))
+	}
+}
+
+func (s *server) leavePresence(cl client) {
+	if e := s.presence.Leave(cl.cId, cl.uId); e != nil {
+		s.lg.Warn("Failed to leave chat presence", zap.Error(e), zap.Int("user id", cl.uId), zap.Int("chat id", cl.cId))
+	}
+}
+
+// keeps clients of this instance alive in presence shared with other instances
+func (s *server) refreshPresence() {
+	s.eg.Go(func() error {
+		ticker := time.NewTicker(PresenceRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			case <-ticker.C:
+				s.mu.Lock()
+				chats := make(map[int][]int)
+				for _, cl := range s.clients {
+					chats[cl.cId] = append(chats[cl.cId], cl.uId)
+				}
+				s.mu.Unlock()
+
+				for cId, uIds := range chats {
+					if e := s.presence.Refresh(cId, uIds); e != nil {
+						s.lg.Warn("Failed to refresh chat presence", zap.Error(e), zap.Int("chat id", cId))
+					}
+				}
+			}
+		}
+	})
+}
+
+// returns amount of users connected to chat through all instances
+func (s *server) presenceHandler(w http.ResponseWriter, r *http.Request) {
+	cId, e := parseChatId(r)
+	if e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(e.Error()))
+		return
+	}
+
+	online, e := s.presence.CountOnline(cId)
+	if e != nil {
+		s.lg.Error("Failed to count online users", zap.Error(e), zap.Int("chat id", cId))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	buf, e := json.Marshal(presenceResponse{ChatId: cId, Online: online})
+	if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,143 @@
+package websocketport
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+type FullQueuePolicy string
+
+const (
+	DropOldest FullQueuePolicy = "drop_oldest" // client misses the oldest queued frame but stays connected
+	Disconnect FullQueuePolicy = "disconnect"  // client is disconnected and has to reconnect to get the rest
+)
+
+const WriteWait = 10 * time.Second
+
+var ErrorUnknownQueuePolicy error = errors.New("full queue policy must be drop_oldest or disconnect")
+var ErrorQueueClosed error = errors.New("client send queue is closed")
+var ErrorSlowClient error = errors.New("client is too slow to read messages")
+
+type SendQueueConfig struct {
+	Size   int
+	Policy FullQueuePolicy
+}
+
+var DefaultSendQueueConfig = SendQueueConfig{Size: 256, Policy: DropOldest}
+
+func ParseFullQueuePolicy(p string) (FullQueuePolicy, error) {
+	switch FullQueuePolicy(p) {
+	case DropOldest, Disconnect:
+		return FullQueuePolicy(p), nil
+	default:
+		return "", ErrorUnknownQueuePolicy
+	}
+}
+
+// published on /debug/vars
+var droppedFrames = expvar.NewInt("websocket_dropped_frames")
+var slowClientDisconnects = expvar.NewInt("websocket_slow_client_disconnects")
+
+// sendQueue is the only writer of data frames to its connection, so broadcast never waits for a slow client
+type sendQueue struct {
+	conn   *websocket.Conn
+	bufs   chan []byte
+	done   chan struct{}
+	policy FullQueuePolicy
+	mu     *sync.Mutex
+	closed bool
+	slow   bool // queue was closed by disconnect policy, writer says it to client before closing conn
+}
+
+func newSendQueue(conn *websocket.Conn, cfg SendQueueConfig) *sendQueue {
+	return &sendQueue{conn: conn, bufs: make(chan []byte, max(cfg.Size, 1)), done: make(chan struct{}), policy: cfg.Policy, mu: &sync.Mutex{}}
+}
+
+// never blocks, full queue is handled by the queue policy
+func (q *sendQueue) push(buf []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrorQueueClosed
+	}
+
+	select {
+	case q.bufs <- buf:
+		return nil
+	default:
+	}
+
+	if q.policy == Disconnect {
+		slowClientDisconnects.Add(1)
+		q.slow = true
+		q.closeLocked() // close frame would wait for the writer, so it is sent by the writer itself
+		return ErrorSlowClient
+	}
+
+	select {
+	case <-q.bufs:
+		droppedFrames.Add(1)
+	default: // writer has just taken one
+	}
+	q.bufs <- buf // only writer takes from queue, so the slot is still free
+	return nil
+}
+
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+}
+
+func (q *sendQueue) closeLocked() {
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func (q *sendQueue) write(mt int, buf []byte) error {
+	q.conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	return q.conn.WriteMessage(mt, buf)
+}
+
+// writes queued frames and pings till queue is closed, failed write closes conn, so the reader stops as well
+func (q *sendQueue) run(pingInterval time.Duration, lg *zap.Logger) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		var e error
+		select {
+		case <-q.done:
+			q.closeSlow()
+			return
+		case buf := <-q.bufs:
+			e = q.write(websocket.TextMessage, buf)
+		case <-ticker.C:
+			e = q.write(websocket.PingMessage, nil)
+		}
+		if e != nil {
+			lg.Warn("Failed to write to websocket connection", zap.Error(e))
+			q.close()
+			q.conn.Close()
+			return
+		}
+	}
+}
+
+// tells slow client to reconnect later and closes conn, so the reader stops as well
+func (q *sendQueue) closeSlow() {
+	q.mu.Lock()
+	slow := q.slow
+	q.mu.Unlock()
+	if !slow {
+		return
+	}
+	q.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ErrorSlowClient.Error()), time.Now().Add(WriteWait))
+	q.conn.Close()
+}
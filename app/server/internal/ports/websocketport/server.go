@@ -10,7 +10,9 @@ import (
 	"sync"
 	"syscall"
 
+	"server/external/adapters/presencerepo"
 	"server/external/adapters/storagerepo"
+	"server/external/auth"
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
@@ -18,7 +20,13 @@ import (
 
 var ErrorServerShutDown error = errors.New("server is shutting down")
 
-func RunServer(addr string, rAddrs map[string]string) {
+// AddrWatcher calls fn with every new value of address key
+type AddrWatcher interface {
+	Subscribe(key string, fn func(addr string) error) error
+}
+
+// storage address is switched at runtime if watcher is not nil
+func RunServer(addr string, rAddrs map[string]string, queueCfg SendQueueConfig, hbCfg HeartbeatConfig, watcher AddrWatcher) {
 	var httpSrv http.Server
 	httpSrv.Addr = addr
 	lg, e := zap.NewDevelopment()
@@ -26,10 +34,26 @@ func RunServer(addr string, rAddrs map[string]string) {
 		log.Fatal("Failed to init logger")
 	}
 
+	issuer, e := auth.NewIssuer(rAddrs["authSecret"], auth.TokenTTL)
+	if e != nil {
+		lg.Fatal("Failed to init token issuer", zap.Error(e))
+	}
+
 	eg, ctx := errgroup.WithContext(context.Background())
-	server := newServer(ctx, eg, storagerepo.NewRepo(ctx, rAddrs, lg), lg, &sync.Mutex{})
+	repo := storagerepo.NewRepo(ctx, rAddrs, lg)
+	if watcher != nil {
+		if e = watcher.Subscribe("storageServerAddr", repo.SetStorageAddr); e != nil {
+			lg.Info("Storage address is not watched", zap.Error(e))
+		}
+	}
+	presence := presencerepo.NewRepo(rAddrs["redisAddr"], ctx, lg)
+	server := newServer(ctx, eg, repo, repo, presence, repo, issuer, queueCfg, hbCfg, lg, &sync.Mutex{})
 	http.HandleFunc("/", server.chatHandler)
+	http.HandleFunc("/register", server.registerHandler)
+	http.HandleFunc("/login", server.loginHandler)
+	http.HandleFunc("/presence", server.presenceHandler)
 	server.waitForMessages()
+	server.refreshPresence()
 
 	sigQuit := make(chan os.Signal, 2)
 	signal.Notify(sigQuit, syscall.SIGINT, syscall.SIGTERM)
@@ -46,6 +70,10 @@ func RunServer(addr string, rAddrs map[string]string) {
 		if e = server.repo.CloseRepo(); e != nil {
 			server.lg.Error("Failed to close repo", zap.Error(e))
 		}
+
+		if e = server.presence.ClosePresence(); e != nil {
+			server.lg.Error("Failed to close presence", zap.Error(e))
+		}
 		return ErrorServerShutDown
 	})
 
@@ -0,0 +1,90 @@
+// cachebench measures how fast the storage consumer can put stored messages to cache.
+//
+//	cachebench [-cache redis|memory] [-redis addr] [-messages n] [-chats n] [-producers n]
+//
+// Messages of every chat get consecutive ids from concurrent producers like they do from consumer claims,
+// after the run the last id of every chat is checked. Keys of chats 1..n are overwritten, so use a scratch redis.
+// BenchmarkAddMessage of redisrepo compares the worker pool with direct writes once CHAT_TEST_REDIS is set.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"server/external/message"
+	"storage/internal/cache_adapters"
+	"storage/internal/cache_adapters/memoryrepo"
+	"storage/internal/cache_adapters/redisrepo"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	kind := flag.String("cache", string(cache_adapters.KindRedis), "cache to measure: redis or memory")
+	addr := flag.String("redis", "localhost:6379", "redis address")
+	total := flag.Int("messages", 100000, "amount of messages to add")
+	chats := flag.Int("chats", 100, "amount of chats messages are spread over")
+	producers := flag.Int("producers", 4, "amount of goroutines adding messages concurrently")
+	flag.Parse()
+
+	cfg := cache_adapters.DefaultConfig
+	k, err := cache_adapters.ParseKind(*kind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Kind = k
+	*chats, *producers = max(*chats, 1), max(*producers, 1)
+
+	var cdb cache_adapters.CacheRepository
+	if cfg.Kind == cache_adapters.KindMemory {
+		cdb = memoryrepo.NewRepo(cfg, zap.NewNop())
+	} else {
+		cdb = redisrepo.NewRepo(*addr, cfg, context.Background(), zap.NewNop())
+	}
+	for cId := 1; cId <= *chats; cId++ {
+		cdb.InvalidateChat(cId)
+	}
+
+	var next atomic.Int64
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for p := 0; p < *producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := next.Add(1) - 1; n < int64(*total); n = next.Add(1) - 1 {
+				msg := message.Message{User: "bench", Text: fmt.Sprintf("bench message %d", n)}
+				msg.SetChatId(int(n%int64(*chats)) + 1)
+				msg.SetId(n/int64(*chats) + 1)
+				cdb.AddMessage(msg)
+			}
+		}()
+	}
+	wg.Wait()
+	if err = cdb.CloseRepo(); err != nil { // waits for queued writes
+		log.Fatal(err)
+	}
+	d := time.Since(start)
+	fmt.Printf("%s: %d messages in %v, %.0f msg/s\n", cfg.Kind, *total, d.Round(time.Millisecond), float64(*total)/d.Seconds())
+
+	if cfg.Kind == cache_adapters.KindRedis { // repo is closed, so last ids are checked with a new one
+		cdb = redisrepo.NewRepo(*addr, cfg, context.Background(), zap.NewNop())
+		defer cdb.CloseRepo()
+	}
+	wrong := 0
+	for cId := 1; cId <= min(*chats, *total); cId++ {
+		lastId := int64((*total-cId)/(*chats) + 1)
+		newer, err := cdb.CheckLastMsgId(cId, lastId-1)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if stale, _ := cdb.CheckLastMsgId(cId, lastId); !newer || stale {
+			wrong++
+		}
+	}
+	fmt.Printf("chats with wrong last id: %d\n", wrong)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"envconfig"
+	"server/external/adapters"
+	"storage/external/deadletter"
+	"storage/internal/cache_adapters"
+	"storage/internal/kafka"
+	"time"
+)
+
+type Config struct {
+	envconfig.Vault
+	KafkaAddr     string        `config:"kafkaAddr" vault:"true" required:"true" usage:"kafka broker addresses separated by commas"`
+	Topics        string        `config:"messageTopics" vault:"true" required:"true" usage:"topics with messages to store separated by commas"`
+	PostgresAddr  string        `config:"postgresAddr" vault:"true" required:"true" usage:"postgres address"`
+	RedisAddr     string        `config:"redisAddr" vault:"true" usage:"redis address, required for redis cache"`
+	ServerAddr    string        `config:"storageServerAddr" vault:"true" required:"true" usage:"address to listen for servers on"`
+	DlqTopic      string        `config:"dlqTopic" usage:"topic for records which failed to be stored"`
+	RetryAttempts int           `config:"retryAttempts" usage:"attempts to store a record before it goes to dead letter topic, unavailable postgres is waited for without limit"`
+	WriteMode     string        `config:"writeMode" usage:"how messages are written to postgres: single, insert or copy"`
+	BatchSize     int           `config:"batchSize" usage:"max amount of records stored in one batch"`
+	BatchInterval time.Duration `config:"batchInterval" usage:"max time a record waits for its batch to be flushed"`
+	CacheKind     string        `config:"cache" usage:"message cache: redis or memory"`
+	CacheTTL      time.Duration `config:"cacheTTL" usage:"cached chat is dropped if it was not written for so long, 0 means never"`
+	CacheSize     int           `config:"cacheSize" usage:"amount of the newest messages of every chat kept in cache"`
+	CacheBytes    int           `config:"cacheChatBytes" usage:"max encoded size of cached messages of a chat, 0 means no limit"`
+	CacheChats    int           `config:"cacheChats" usage:"max amount of chats kept by memory cache, 0 means no limit"`
+	AutoMigrate   bool          `config:"autoMigrate" flag:"migrate" usage:"apply pending database migrations on startup"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Vault:         envconfig.Vault{VaultMount: envconfig.DefaultVaultMount, VaultPoll: envconfig.DefaultPollInterval},
+		DlqTopic:      deadletter.DefaultTopic,
+		RetryAttempts: kafka.DefaultRetryConfig.MaxAttempts,
+		WriteMode:     string(adapters.BatchCopy),
+		BatchSize:     kafka.DefaultBatchConfig.Size,
+		BatchInterval: kafka.DefaultBatchConfig.Interval,
+		CacheKind:     string(cache_adapters.DefaultConfig.Kind),
+		CacheTTL:      cache_adapters.DefaultConfig.TTL,
+		CacheSize:     cache_adapters.DefaultConfig.MaxMessages,
+		CacheBytes:    cache_adapters.DefaultConfig.MaxBytes,
+		CacheChats:    cache_adapters.DefaultConfig.MaxChats,
+		AutoMigrate:   true,
+	}
+}
+
+func (cfg Config) cacheConfig() (cache_adapters.Config, error) {
+	kind, err := cache_adapters.ParseKind(cfg.CacheKind)
+	return cache_adapters.Config{Kind: kind, TTL: cfg.CacheTTL, MaxMessages: cfg.CacheSize, MaxBytes: cfg.CacheBytes, MaxChats: cfg.CacheChats}, err
+}
+
+func (cfg Config) retryConfig() kafka.RetryConfig {
+	retry := kafka.DefaultRetryConfig
+	retry.MaxAttempts = max(cfg.RetryAttempts, 1)
+	return retry
+}
+
+func (cfg Config) batchConfig() kafka.BatchConfig {
+	return kafka.BatchConfig{Size: max(cfg.BatchSize, 1), Interval: cfg.BatchInterval}
+}
+
+func (cfg Config) Validate() error {
+	if _, err := parseBatchMode(cfg.WriteMode); err != nil {
+		return err
+	}
+	cacheCfg, err := cfg.cacheConfig()
+	if err != nil {
+		return err
+	}
+	if cacheCfg.Kind == cache_adapters.KindRedis && cfg.RedisAddr == "" {
+		return ErrorNoRedisAddr
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// dlq inspects records of the dead letter topic and produces them back to the topic they failed in.
+//
+//	dlq [-brokers addr] [-topic name] list [-from offset] [-limit n]
+//	dlq [-brokers addr] [-topic name] redrive [-from offset] [-to offset] [-target topic] [-dry-run]
+//
+// Redriven records keep their event id, so records stored meanwhile are not duplicated.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"storage/external/deadletter"
+	"storage/external/event"
+
+	"github.com/IBM/sarama"
+)
+
+// reads records with offsets in [from, to] from every partition, to < 0 means till the end of partition
+func readRecords(client sarama.Client, topic string, from int64, to int64, limit int, handle func(*sarama.ConsumerMessage) error) error {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	read := 0
+	for _, p := range partitions {
+		oldest, err := client.GetOffset(topic, p, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		newest, err := client.GetOffset(topic, p, sarama.OffsetNewest) // offset of the next record
+		if err != nil {
+			return err
+		}
+		start, end := max(from, oldest), newest-1
+		if to >= 0 {
+			end = min(end, to)
+		}
+		if start > end {
+			continue
+		}
+
+		pc, err := consumer.ConsumePartition(topic, p, start)
+		if err != nil {
+			return err
+		}
+		for msg := range pc.Messages() {
+			if err = handle(msg); err != nil {
+				pc.Close()
+				return err
+			}
+			read++
+			if msg.Offset >= end || (limit > 0 && read >= limit) {
+				break
+			}
+		}
+		if err = pc.Close(); err != nil {
+			return err
+		}
+		if limit > 0 && read >= limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+func printRecord(msg *sarama.ConsumerMessage) error {
+	h := msg.Headers
+	fmt.Printf("partition %d offset %d failed at %s after %s attempts\n", msg.Partition, msg.Offset, deadletter.HeaderValue(h, deadletter.HeaderFailedAt), deadletter.HeaderValue(h, deadletter.HeaderAttempts))
+	fmt.Printf("  source: %s/%s/%s\n", deadletter.HeaderValue(h, deadletter.HeaderSourceTopic), deadletter.HeaderValue(h, deadletter.HeaderSourcePartition), deadletter.HeaderValue(h, deadletter.HeaderSourceOffset))
+	fmt.Printf("  reason: %s\n", deadletter.HeaderValue(h, deadletter.HeaderReason))
+	m, err := event.DecodeRecord(h, msg.Value)
+	if err != nil {
+		fmt.Printf("  payload: %d undecodable bytes\n", len(msg.Value))
+		return nil
+	}
+	fmt.Printf("  message: chat %d user %d (%s) event %s: %q\n", m.GetChatId(), m.GetUserId(), m.User, m.GetEventId(), m.Text)
+	return nil
+}
+
+func main() {
+	brokers := flag.String("brokers", "localhost:9092", "kafka broker address")
+	topic := flag.String("topic", deadletter.DefaultTopic, "dead letter topic")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] list|redrive [command flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	from := cmd.Int64("from", 0, "first offset to read")
+	to := cmd.Int64("to", -1, "last offset to read, -1 means the newest one")
+	limit := cmd.Int("limit", 20, "max amount of records to list, 0 means no limit")
+	target := cmd.String("target", event.AddedTopic, "topic to produce redriven records to")
+	dryRun := cmd.Bool("dry-run", false, "only print records which would be redriven")
+	cmd.Parse(flag.Args()[1:])
+
+	config := sarama.NewConfig()
+	config.Version = sarama.DefaultVersion
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	client, err := sarama.NewClient([]string{*brokers}, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	switch cmd.Name() {
+	case "list":
+		err = readRecords(client, *topic, *from, *to, *limit, printRecord)
+	case "redrive":
+		err = redrive(client, *topic, *target, *from, *to, *dryRun)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func redrive(client sarama.Client, topic string, target string, from int64, to int64, dryRun bool) error {
+	var producer sarama.SyncProducer
+	if !dryRun {
+		var err error
+		if producer, err = sarama.NewSyncProducerFromClient(client); err != nil {
+			return err
+		}
+		defer producer.Close()
+	}
+
+	redriven := 0
+	err := readRecords(client, topic, from, to, 0, func(msg *sarama.ConsumerMessage) error {
+		if dryRun {
+			return printRecord(msg)
+		}
+		_, _, err := producer.SendMessage(&sarama.ProducerMessage{
+			Topic:   target,
+			Value:   sarama.ByteEncoder(msg.Value),
+			Headers: deadletter.OriginalHeaders(msg.Headers),
+		})
+		if err == nil {
+			redriven++
+		}
+		return err
+	})
+	fmt.Printf("redriven %d records to %s\n", redriven, target)
+	return err
+}
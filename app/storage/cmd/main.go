@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"envconfig"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"server/external/adapters"
 	"server/external/adapters/postgresrepo"
+	"storage/external/deadletter"
+	"storage/external/event"
+	"storage/external/producer"
+	"storage/internal/cache_adapters"
+	"storage/internal/cache_adapters/memoryrepo"
 	"storage/internal/cache_adapters/redisrepo"
 	"storage/internal/consumer"
 	"storage/internal/ports/httpnetserver"
@@ -17,41 +25,109 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func runServer(msgHandler *consumer.MessageHandler, serverAddr string) {
-	httpnetserver.RunServer(serverAddr, msgHandler)
+func runServer(msgHandler *consumer.MessageHandler, udb adapters.UserRepository, serverAddr string) {
+	httpnetserver.RunServer(serverAddr, msgHandler, udb)
 }
 
-func connectToDbs(ctx context.Context, DbAddr string, cDbAddr string, lg *zap.Logger) *consumer.MessageHandler {
+func connectToCache(ctx context.Context, cfg cache_adapters.Config, cDbAddr string, lg *zap.Logger) cache_adapters.CacheRepository {
+	if cfg.Kind == cache_adapters.KindMemory {
+		return memoryrepo.NewRepo(cfg, lg.With(zap.String("cdb", "memory")))
+	}
+	return redisrepo.NewRepo(cDbAddr, cfg, ctx, lg.With(zap.String("cdb", "redis")))
+}
+
+// users are kept in the same postgres db as messages
+func connectToDbs(ctx context.Context, DbAddr string, cDbAddr string, cacheCfg cache_adapters.Config, brokers string, mode adapters.BatchMode, lg *zap.Logger) (*consumer.MessageHandler, adapters.UserRepository) {
 	eg, newCtx := errgroup.WithContext(ctx)
 	db := postgresrepo.NewRepo(DbAddr, newCtx, lg.With(zap.String("db", "postgres")))
-	cdb := redisrepo.NewRepo(cDbAddr, newCtx, lg.With(zap.String("cdb", "redis")))
-	return consumer.NewMessageHandler(newCtx, db, cdb, eg, lg)
+	cdb := connectToCache(newCtx, cacheCfg, cDbAddr, lg)
+	np, err := producer.NewProducer(newCtx, brokers, lg.With(zap.String("storage", "notifier")), event.PersistedTopic)
+	if err != nil {
+		lg.Fatal("Failed to create persisted messages producer", zap.Error(err))
+	}
+	return consumer.NewMessageHandler(newCtx, db, db, mode, cdb, np, eg, lg), db
 }
 
 var group = "2"
 
+var ErrorUnknownWriteMode error = errors.New("unknown write mode, expected single, insert or copy")
+var ErrorNoRedisAddr error = errors.New("redis cache needs redisAddr")
+
+func parseBatchMode(s string) (adapters.BatchMode, error) {
+	switch m := adapters.BatchMode(s); m {
+	case adapters.BatchSingle, adapters.BatchInsert, adapters.BatchCopy:
+		return m, nil
+	}
+	return "", ErrorUnknownWriteMode
+}
+
 func main() {
-	es := envconfig.NewEnvStorage()
-	brokers := es.EnvGetAddr("kafkaAddr")
-	topics := es.EnvGetAddr("messageTopics")
+	cfg := defaultConfig()
+	ld, err := envconfig.NewLoader(flag.CommandLine, &cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
 
 	lg, err := zap.NewDevelopment()
 	if err != nil {
 		log.Fatal("Failed to init logger")
 	}
+
+	switch flag.Arg(0) {
+	case "migrate":
+		cfgDbAddr := func() string {
+			if err := ld.Load(); err != nil {
+				log.Fatal(err)
+			}
+			return cfg.PostgresAddr
+		}
+		if err = runMigrate(flag.Args()[1:], cfgDbAddr, lg.With(zap.String("storage", "migrate"))); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "config":
+		err = ld.Load()
+		ld.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err = ld.Load(); err != nil {
+		log.Fatal(err)
+	}
+	mode, _ := parseBatchMode(cfg.WriteMode) // checked by Load
+	cacheCfg, _ := cfg.cacheConfig()
+
 	lg.Info("Starting storage")
-	lg.Warn("check", zap.String("brokers", brokers), zap.String("topics", topics))
+	lg.Warn("check", zap.String("brokers", cfg.KafkaAddr), zap.String("topics", cfg.Topics))
 	sarama.Logger = zap.NewStdLog(lg.With(zap.String("storage", "sarama")))
 
 	ctx, cncl := context.WithCancel(context.Background())
-	msgHandler := connectToDbs(ctx, es.EnvGetAddr("postgresAddr"), es.EnvGetAddr("redisAddr"), lg)
-	consumer, err := consumer.RunConsumer(ctx, msgHandler, brokers, group, topics)
+	if cfg.AutoMigrate {
+		if err = migrateUp(ctx, cfg.PostgresAddr, lg.With(zap.String("storage", "migrate"))); err != nil {
+			log.Fatal(err)
+		}
+	}
+	msgHandler, udb := connectToDbs(ctx, cfg.PostgresAddr, cfg.RedisAddr, cacheCfg, cfg.KafkaAddr, mode, lg)
+	ld.KeepToken(ctx, func(err error) {
+		lg.Warn("Failed to renew vault token", zap.Error(err))
+	})
+	if w, ok := ld.Watcher(); ok {
+		watchAddrs(ctx, w, cfg, msgHandler, lg.With(zap.String("storage", "watcher")))
+	}
+	dlq, err := deadletter.NewWriter(ctx, cfg.KafkaAddr, cfg.DlqTopic, lg.With(zap.String("storage", "dead letters")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	consumer, err := consumer.RunConsumer(ctx, msgHandler, cfg.KafkaAddr, group, cfg.Topics, dlq, cfg.retryConfig(), cfg.batchConfig())
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	lg.Info("Sarama is running")
-	runServer(msgHandler, es.EnvGetAddr("storageServerAddr"))
+	runServer(msgHandler, udb, cfg.ServerAddr)
 
 	sigterm := make(chan os.Signal, 2)
 	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
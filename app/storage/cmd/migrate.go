@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"server/external/adapters/postgresrepo"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `usage: storage migrate [-db addr] up [-to version] | down [-steps n] | force version | status`
+
+// applies every pending migration, storage instances started together wait for each other on the migration lock
+func migrateUp(ctx context.Context, dbAddr string, lg *zap.Logger) error {
+	mg, err := postgresrepo.NewMigrator(ctx, dbAddr, lg)
+	if err != nil {
+		return err
+	}
+	defer mg.Close(context.Background())
+
+	n, err := mg.Up(ctx, 0)
+	if err != nil {
+		return err
+	}
+	lg.Info("Database schema is up to date", zap.Int("applied migrations", n))
+	return nil
+}
+
+// runs migrate subcommand with args following it, postgres address is taken from storage config unless -db is given
+func runMigrate(args []string, cfgDbAddr func() string, lg *zap.Logger) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbAddr := fs.String("db", "", "postgres address, postgresAddr of storage config is used if empty")
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), migrateUsage); fs.PrintDefaults() }
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *dbAddr == "" {
+		*dbAddr = cfgDbAddr()
+	}
+
+	ctx := context.Background()
+	mg, err := postgresrepo.NewMigrator(ctx, *dbAddr, lg)
+	if err != nil {
+		return err
+	}
+	defer mg.Close(ctx)
+
+	cmd := flag.NewFlagSet(fs.Arg(0), flag.ExitOnError)
+	to := cmd.Int64("to", 0, "last version to apply, 0 means the newest one")
+	steps := cmd.Int("steps", 1, "amount of migrations to revert")
+	cmd.Parse(fs.Args()[1:])
+
+	switch cmd.Name() {
+	case "up":
+		n, err := mg.Up(ctx, *to)
+		fmt.Printf("applied %d migrations\n", n)
+		return err
+	case "down":
+		n, err := mg.Down(ctx, *steps)
+		fmt.Printf("reverted %d migrations\n", n)
+		return err
+	case "force":
+		version, err := strconv.ParseInt(cmd.Arg(0), 10, 64)
+		if err != nil {
+			fs.Usage()
+			os.Exit(2)
+		}
+		return mg.Force(ctx, version)
+	case "status":
+		st, err := mg.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range st {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%06d %-8s %s\n", m.Version, state, m.Name)
+		}
+		return nil
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
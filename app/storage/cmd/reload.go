@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"envconfig"
+	"storage/internal/consumer"
+
+	"go.uber.org/zap"
+)
+
+// repos which can be switched to another address at runtime
+type reconnecter interface {
+	Reconnect(addr string) error
+}
+
+// reconnects dbs when their addresses change in vault, kafka and listen addresses still need a restart
+func watchAddrs(ctx context.Context, w *envconfig.Watcher, cfg Config, mh *consumer.MessageHandler, lg *zap.Logger) {
+	subscribe := func(key string, fn func(addr string) error) {
+		if err := w.Subscribe(key, fn); err != nil {
+			lg.Info("Address is not watched", zap.String("key", key), zap.Error(err))
+		}
+	}
+
+	if db, ok := mh.Db.(reconnecter); ok {
+		subscribe("postgresAddr", func(addr string) error {
+			if cfg.AutoMigrate {
+				if err := migrateUp(ctx, addr, lg.With(zap.String("storage", "migrate"))); err != nil {
+					return err
+				}
+			}
+			return db.Reconnect(addr)
+		})
+	}
+	if cdb, ok := mh.Cdb.(reconnecter); ok {
+		subscribe("redisAddr", cdb.Reconnect)
+	}
+
+	go w.Run(ctx, func(key string, err error) {
+		lg.Warn("Failed to watch address", zap.String("key", key), zap.Error(err))
+	})
+}
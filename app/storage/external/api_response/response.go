@@ -3,17 +3,18 @@ package storage_response
 import (
 	"bytes"
 	"encoding/gob"
+	"server/external/account"
 	"server/external/message"
 )
 
 type StorageResponse struct {
-	Msgs                    []message.Message
-	Last_message_time_stamp int64
-	ErrExplanation          string
+	Msgs            []message.Message
+	Last_message_id int64
+	ErrExplanation  string
 }
 
-func NewResponse(msgs []message.Message, lMsgTimeSt int64) StorageResponse {
-	return StorageResponse{Msgs: msgs, Last_message_time_stamp: lMsgTimeSt}
+func NewResponse(msgs []message.Message, lMsgId int64) StorageResponse {
+	return StorageResponse{Msgs: msgs, Last_message_id: lMsgId}
 }
 
 func (r *StorageResponse) SetErrExplanation(expl string) {
@@ -28,8 +29,8 @@ func (r StorageResponse) GetMsgs() []message.Message {
 	return r.Msgs
 }
 
-func (r StorageResponse) GetLastMessageTimeStamp() int64 {
-	return r.Last_message_time_stamp
+func (r StorageResponse) GetLastMessageId() int64 {
+	return r.Last_message_id
 }
 
 func DecodeResponseFromBytes(b []byte) (StorageResponse, error) {
@@ -51,3 +52,32 @@ func EncodeResponseToBytes(resp StorageResponse) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+type UserResponse struct {
+	User           account.User
+	ErrExplanation string
+}
+
+func NewUserResponse(u account.User) UserResponse {
+	return UserResponse{User: u}
+}
+
+func (r UserResponse) GetUser() account.User {
+	return r.User
+}
+
+func DecodeUserResponseFromBytes(b []byte) (UserResponse, error) {
+	var resp UserResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&resp); err != nil {
+		return UserResponse{}, err
+	}
+	return resp, nil
+}
+
+func EncodeUserResponseToBytes(resp UserResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
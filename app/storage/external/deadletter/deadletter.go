@@ -0,0 +1,101 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"storage/external/event"
+	"storage/external/producer"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+)
+
+const DefaultTopic = event.AddedTopic + ".dlq"
+
+// headers added to dead records, original headers are kept as well
+const (
+	HeaderReason          = "dlq-reason"
+	HeaderSourceTopic     = "dlq-source-topic"
+	HeaderSourcePartition = "dlq-source-partition"
+	HeaderSourceOffset    = "dlq-source-offset"
+	HeaderAttempts        = "dlq-attempts"
+	HeaderFailedAt        = "dlq-failed-at"
+)
+
+var ErrorNotConfirmed error = errors.New("dead letter topic didn't confirm the record")
+
+type Writer struct {
+	producer *producer.Producer
+	ctx      context.Context
+	lg       *zap.Logger
+}
+
+func NewWriter(ctx context.Context, kafAddr string, topic string, lg *zap.Logger) (*Writer, error) {
+	p, err := producer.NewProducer(ctx, kafAddr, lg, topic)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{producer: p, ctx: ctx, lg: lg}, nil
+}
+
+func header(key string, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// waits till kafka confirms the record, so source record can be marked right after it
+func (w *Writer) Write(msg *sarama.ConsumerMessage, reason error, attempts int) error {
+	headers := append(OriginalHeaders(msg.Headers),
+		header(HeaderReason, reason.Error()),
+		header(HeaderSourceTopic, msg.Topic),
+		header(HeaderSourcePartition, strconv.Itoa(int(msg.Partition))),
+		header(HeaderSourceOffset, strconv.FormatInt(msg.Offset, 10)),
+		header(HeaderAttempts, strconv.Itoa(attempts)),
+		header(HeaderFailedAt, time.Now().UTC().Format(time.RFC3339)),
+	)
+
+	done := make(chan error, 1)
+	w.producer.WriteMessage(msg.Value, func(err error) { done <- err }, headers...)
+	select {
+	case err := <-done:
+		if err != nil {
+			w.lg.Error("Failed to write record to dead letter topic", zap.Error(err), zap.String("source topic", msg.Topic), zap.Int64("source offset", msg.Offset))
+			return err
+		}
+	case <-w.ctx.Done():
+		return ErrorNotConfirmed
+	}
+	w.lg.Warn("Record moved to dead letter topic", zap.Error(reason), zap.String("source topic", msg.Topic), zap.Int32("source partition", msg.Partition), zap.Int64("source offset", msg.Offset))
+	return nil
+}
+
+func IsDeadLetterHeader(key string) bool {
+	switch key {
+	case HeaderReason, HeaderSourceTopic, HeaderSourcePartition, HeaderSourceOffset, HeaderAttempts, HeaderFailedAt:
+		return true
+	default:
+		return false
+	}
+}
+
+// original headers of dead record, so it can be produced to source topic again
+func OriginalHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	orig := make([]sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		if h != nil && !IsDeadLetterHeader(string(h.Key)) {
+			orig = append(orig, *h)
+		}
+	}
+	return orig
+}
+
+func HeaderValue(headers []*sarama.RecordHeader, key string) string {
+	for _, h := range headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"server/external/message"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of MessageAdded from message_event.proto
+const (
+	fieldUserId   protowire.Number = 1
+	fieldChatId   protowire.Number = 2
+	fieldUser     protowire.Number = 3
+	fieldText     protowire.Number = 4
+	fieldClientId protowire.Number = 5
+	fieldEventId  protowire.Number = 6
+)
+
+// field numbers of MessagePersisted from message_event.proto
+const (
+	fieldPersistedId      protowire.Number = 1
+	fieldPersistedMessage protowire.Number = 2
+)
+
+const AddedTopic = "chat.messages.add"
+const PersistedTopic = "chat.messages.persisted"
+
+const HeaderVersion = "version"
+const HeaderContentType = "content-type"
+const MessageEventVersion = "1"
+const ProtobufContentType = "application/x-protobuf"
+
+var ErrorUnknownVersion error = errors.New("unknown message event version")
+var ErrorMalformedEvent error = errors.New("malformed message event")
+
+func NewEventId() string {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// event id of records produced without it, the same record always gets the same id
+func RecordEventId(topic string, partition int32, offset int64) string {
+	return fmt.Sprintf("%s/%d/%d", topic, partition, offset)
+}
+
+func EncodeMessage(m message.Message) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, fieldUserId, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.GetUserId()))
+	b = protowire.AppendTag(b, fieldChatId, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.GetChatId()))
+	b = protowire.AppendTag(b, fieldUser, protowire.BytesType)
+	b = protowire.AppendString(b, m.User)
+	b = protowire.AppendTag(b, fieldText, protowire.BytesType)
+	b = protowire.AppendString(b, m.Text)
+	b = protowire.AppendTag(b, fieldClientId, protowire.BytesType)
+	b = protowire.AppendString(b, m.GetClientId())
+	b = protowire.AppendTag(b, fieldEventId, protowire.BytesType)
+	b = protowire.AppendString(b, m.GetEventId())
+	return b
+}
+
+// unknown fields are skipped, so records from newer producers stay readable
+func DecodeMessage(b []byte) (message.Message, error) {
+	var m message.Message
+	for len(b) > 0 {
+		num, tp, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == fieldUserId && tp == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.SetUserId(int(int64(v)))
+			b = b[n:]
+		case num == fieldChatId && tp == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.SetChatId(int(int64(v)))
+			b = b[n:]
+		case num == fieldUser && tp == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.User = v
+			b = b[n:]
+		case num == fieldText && tp == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.Text = v
+			b = b[n:]
+		case num == fieldClientId && tp == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.SetClientId(v)
+			b = b[n:]
+		case num == fieldEventId && tp == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			m.SetEventId(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, tp, b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return m, nil
+}
+
+func Headers() []sarama.RecordHeader {
+	return []sarama.RecordHeader{
+		{Key: []byte(HeaderVersion), Value: []byte(MessageEventVersion)},
+		{Key: []byte(HeaderContentType), Value: []byte(ProtobufContentType)},
+	}
+}
+
+// picks decoder by version header, records without it were written by gob producers before migration
+func DecodeRecord(headers []*sarama.RecordHeader, value []byte) (message.Message, error) {
+	for _, h := range headers {
+		if h == nil || string(h.Key) != HeaderVersion {
+			continue
+		}
+		if string(h.Value) != MessageEventVersion {
+			return message.Message{}, fmt.Errorf("%w: %q", ErrorUnknownVersion, h.Value)
+		}
+		return DecodeMessage(value)
+	}
+	return message.DecodeMsgFromBytes(value)
+}
+
+// encodes message stored by storage, id is kept in MessagePersisted and the rest in nested MessageAdded
+func EncodePersistedMessage(m message.Message) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, fieldPersistedId, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.GetId()))
+	b = protowire.AppendTag(b, fieldPersistedMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, EncodeMessage(m))
+	return b
+}
+
+func DecodePersistedMessage(b []byte) (message.Message, error) {
+	var m message.Message
+	var id int64
+	for len(b) > 0 {
+		num, tp, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == fieldPersistedId && tp == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			id = int64(v)
+			b = b[n:]
+		case num == fieldPersistedMessage && tp == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			var err error
+			if m, err = DecodeMessage(v); err != nil {
+				return message.Message{}, err
+			}
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, tp, b)
+			if n < 0 {
+				return message.Message{}, fmt.Errorf("%w: %v", ErrorMalformedEvent, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	m.SetId(id)
+	return m, nil
+}
+
+// persisted records were never gob encoded, so version header is required
+func DecodePersistedRecord(headers []*sarama.RecordHeader, value []byte) (message.Message, error) {
+	for _, h := range headers {
+		if h == nil || string(h.Key) != HeaderVersion {
+			continue
+		}
+		if string(h.Value) != MessageEventVersion {
+			return message.Message{}, fmt.Errorf("%w: %q", ErrorUnknownVersion, h.Value)
+		}
+		return DecodePersistedMessage(value)
+	}
+	return message.Message{}, fmt.Errorf("%w: no version header", ErrorUnknownVersion)
+}
@@ -2,15 +2,26 @@ package producer
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 	"go.uber.org/zap"
 )
 
+// called once kafka confirms the record (with nil) or producer gives up on it
+type DeliveryCallback func(error)
+
+var ErrorProducerClosed error = errors.New("producer is closed")
+
 type Producer struct {
 	producer sarama.AsyncProducer
 	topic    string
+	mu       *sync.RWMutex // held by writers, so input isn't closed under them
+	closed   bool
+	once     *sync.Once
+	done     chan struct{} // closed once every sent record is reported
 }
 
 func NewProducer(ctx context.Context, kafAddr string, lg *zap.Logger, topic string) (*Producer, error) {
@@ -21,25 +32,81 @@ func NewProducer(ctx context.Context, kafAddr string, lg *zap.Logger, topic stri
 		lg.Error("Failed to create kafka producer", zap.Error(err), zap.String("kafka br addr", kafAddr), zap.String("kafka topic", topic))
 		return nil, err
 	}
+	return NewFromAsync(ctx, producer, lg, topic), nil
+}
+
+// producer must return successes, it is closed once ctx is done or by Close
+func NewFromAsync(ctx context.Context, producer sarama.AsyncProducer, lg *zap.Logger, topic string) *Producer {
+	pr := &Producer{producer: producer, topic: topic, mu: &sync.RWMutex{}, once: &sync.Once{}, done: make(chan struct{})}
+	go pr.notifyDeliveries(lg)
 	go func() {
-		for {
-			select {
-			case err := <-producer.Errors():
-				lg.Warn("Kafka producer error", zap.Error(err.Err))
-			case <-ctx.Done():
-				if err := producer.Close(); err != nil {
-					lg.Warn("Kafka producer close error", zap.Error(err))
-				}
-			}
+		select {
+		case <-ctx.Done():
+			pr.Close()
+		case <-pr.done:
 		}
 	}()
-	return &Producer{producer: producer, topic: topic}, nil
+	return pr
 }
 
-func (pr *Producer) WriteMessage(m []byte) {
+// channels are read till sarama closes them, so records in flight on close are reported too
+func (pr *Producer) notifyDeliveries(lg *zap.Logger) {
+	defer close(pr.done)
+	successes, errs := pr.producer.Successes(), pr.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			notifyDelivery(msg, nil)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			lg.Warn("Kafka producer error", zap.Error(err.Err))
+			notifyDelivery(err.Msg, err.Err)
+		}
+	}
+}
+
+// waits till records in flight are reported, later writes fail with ErrorProducerClosed
+func (pr *Producer) Close() {
+	pr.once.Do(func() {
+		pr.mu.Lock()
+		pr.closed = true
+		pr.mu.Unlock()
+		pr.producer.AsyncClose()
+	})
+	<-pr.done
+}
+
+func notifyDelivery(msg *sarama.ProducerMessage, err error) {
+	if msg == nil {
+		return
+	}
+	if cb, ok := msg.Metadata.(DeliveryCallback); ok && cb != nil {
+		cb(err)
+	}
+}
+
+// cb may be nil if caller doesn't care about delivery
+func (pr *Producer) WriteMessage(m []byte, cb DeliveryCallback, headers ...sarama.RecordHeader) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	if pr.closed {
+		if cb != nil {
+			cb(ErrorProducerClosed)
+		}
+		return
+	}
 	pr.producer.Input() <- &sarama.ProducerMessage{
 		Topic:     pr.topic,
 		Value:     sarama.ByteEncoder(m),
+		Headers:   headers,
+		Metadata:  cb,
 		Timestamp: time.Now(),
 	}
 }
@@ -47,9 +114,10 @@ func (pr *Producer) WriteMessage(m []byte) {
 func createProducer(brokerList []string) (sarama.AsyncProducer, error) {
 	c := sarama.NewConfig()
 	c.Version = sarama.DefaultVersion
-	c.Producer.RequiredAcks = sarama.WaitForLocal
+	c.Producer.RequiredAcks = sarama.WaitForAll
 	c.Producer.Compression = sarama.CompressionSnappy
 	c.Producer.Flush.Frequency = 500 * time.Millisecond
+	c.Producer.Return.Successes = true
 
 	producer, err := sarama.NewAsyncProducer(brokerList, c)
 	if err != nil {
@@ -0,0 +1,101 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"server/external/message"
+	"storage/external/event"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+)
+
+const MsgsBufSize = 256
+
+// Subscriber reads persisted messages topic in its own consumer group, so it gets every partition,
+// offsets are committed once messages are handed over, so a restarted subscriber of the same group
+// goes on from where it stopped, a new group starts from the newest offset
+type Subscriber struct {
+	msgs chan message.Message
+	stop context.CancelFunc
+}
+
+// claimHandler is kept apart not to export sarama callbacks by Subscriber
+type claimHandler struct {
+	msgs chan<- message.Message
+	lg   *zap.Logger
+}
+
+func NewSubscriber(ctx context.Context, kafAddr string, group string, lg *zap.Logger, topic string) (*Subscriber, error) {
+	c := sarama.NewConfig()
+	c.Version = sarama.DefaultVersion
+	c.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	cg, err := sarama.NewConsumerGroup([]string{kafAddr}, group, c)
+	if err != nil {
+		lg.Error("Failed to create kafka consumer group", zap.Error(err), zap.String("kafka br addr", kafAddr), zap.String("group", group))
+		return nil, err
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	sub := &Subscriber{msgs: make(chan message.Message, MsgsBufSize), stop: stop}
+	go func() {
+		defer close(sub.msgs)
+		handler := claimHandler{msgs: sub.msgs, lg: lg}
+		for ctx.Err() == nil {
+			if err := cg.Consume(ctx, []string{topic}, handler); err != nil && !errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				lg.Warn("Persisted messages consumer stopped", zap.Error(err), zap.String("kafka topic", topic), zap.String("group", group))
+				break
+			}
+		}
+		if err := cg.Close(); err != nil { // commits marked offsets
+			lg.Warn("Kafka consumer group close error", zap.Error(err))
+		}
+	}()
+	return sub, nil
+}
+
+func (claimHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (claimHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h claimHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case mb, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			msg, err := event.DecodePersistedRecord(mb.Headers, mb.Value)
+			if err != nil {
+				h.lg.Warn("Failed to decode persisted message", zap.Error(err), zap.Int64("offset", mb.Offset))
+				session.MarkMessage(mb, "")
+				continue
+			}
+			select {
+			case h.msgs <- msg:
+				session.MarkMessage(mb, "")
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// channel is closed once ctx is done, subscriber is closed or kafka is lost
+func (sub *Subscriber) Messages() <-chan message.Message {
+	return sub.msgs
+}
+
+// stops consuming and waits till offsets are committed and the group is closed
+func (sub *Subscriber) Close() {
+	sub.stop()
+	for range sub.msgs {
+	}
+}
@@ -0,0 +1,146 @@
+package subscriber
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"server/external/message"
+	"storage/external/event"
+	"storage/external/producer"
+
+	"go.uber.org/zap"
+)
+
+const probePrefix = "probe"
+
+// tests are run against kafka given by CHAT_TEST_KAFKA, every test writes to its own chat and uses its own groups
+func newTestProducer(t *testing.T) (*producer.Producer, string) {
+	addr := os.Getenv("CHAT_TEST_KAFKA")
+	if addr == "" {
+		t.Skip("CHAT_TEST_KAFKA is not set")
+	}
+	pr, err := producer.NewProducer(context.Background(), addr, zap.NewNop(), event.PersistedTopic)
+	if err != nil {
+		t.Skipf("kafka is unavailable: %v", err)
+	}
+	t.Cleanup(pr.Close)
+	return pr, addr
+}
+
+func testChatId() int {
+	return int(time.Now().UnixNano() % (1 << 30))
+}
+
+func testGroup(t *testing.T, instance string) string {
+	return fmt.Sprintf("test-%s-%d-%s", t.Name(), time.Now().UnixNano(), instance)
+}
+
+func newTestSubscriber(t *testing.T, addr string, group string) *Subscriber {
+	sub, err := NewSubscriber(context.Background(), addr, group, zap.NewNop(), event.PersistedTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Close)
+	return sub
+}
+
+func publish(t *testing.T, pr *producer.Producer, cId int, text string) {
+	msg := message.Message{User: "tester", Text: text}
+	msg.SetChatId(cId)
+	msg.SetId(time.Now().UnixNano())
+	done := make(chan error, 1)
+	pr.WriteMessage(event.EncodePersistedMessage(msg), func(err error) { done <- err }, event.Headers()...)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns sorted texts of chat got till timeout, probes are skipped, partitions keep no order between each other
+func receive(sub *Subscriber, cId int, timeout time.Duration) []string {
+	texts := make([]string, 0)
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				sort.Strings(texts)
+				return texts
+			}
+			if msg.GetChatId() == cId && !strings.HasPrefix(msg.Text, probePrefix) {
+				texts = append(texts, msg.Text)
+			}
+		case <-deadline:
+			sort.Strings(texts)
+			return texts
+		}
+	}
+}
+
+// new group starts from the newest offset once it joins, so probes are published till one is got
+func waitJoined(t *testing.T, pr *producer.Producer, sub *Subscriber, cId int) {
+	for i := 0; i < 30; i++ {
+		publish(t, pr, cId, fmt.Sprintf("%s %d", probePrefix, i))
+		deadline := time.After(time.Second)
+	wait:
+		for {
+			select {
+			case msg := <-sub.Messages():
+				if msg.GetChatId() == cId {
+					return
+				}
+			case <-deadline:
+				break wait
+			}
+		}
+	}
+	t.Fatal("subscriber didn't join its group")
+}
+
+func equalTexts(a []string, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+func TestEveryInstanceGetsEveryMessageOnce(t *testing.T) {
+	pr, addr := newTestProducer(t)
+	cId := testChatId()
+	subs := []*Subscriber{newTestSubscriber(t, addr, testGroup(t, "a")), newTestSubscriber(t, addr, testGroup(t, "b"))}
+	for _, sub := range subs {
+		waitJoined(t, pr, sub, cId)
+	}
+
+	publish(t, pr, cId, "m1")
+	publish(t, pr, cId, "m2")
+	for i, sub := range subs {
+		if got := receive(sub, cId, 3*time.Second); !equalTexts(got, []string{"m1", "m2"}) {
+			t.Errorf("instance %d got %q, want m1 and m2 once", i, got)
+		}
+	}
+}
+
+func TestRestartedInstanceGoesOnFromCommittedOffset(t *testing.T) {
+	pr, addr := newTestProducer(t)
+	cId := testChatId()
+	group := testGroup(t, "a")
+
+	sub, err := NewSubscriber(context.Background(), addr, group, zap.NewNop(), event.PersistedTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJoined(t, pr, sub, cId)
+	publish(t, pr, cId, "before restart")
+	if got := receive(sub, cId, 3*time.Second); !equalTexts(got, []string{"before restart"}) {
+		t.Fatalf("got %q before restart", got)
+	}
+	sub.Close()
+
+	publish(t, pr, cId, "while stopped")
+	sub = newTestSubscriber(t, addr, group)
+	if got := receive(sub, cId, 10*time.Second); !equalTexts(got, []string{"while stopped"}) {
+		t.Errorf("restarted instance got %q, want only the message published while it was stopped", got)
+	}
+}
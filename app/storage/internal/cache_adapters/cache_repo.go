@@ -1,9 +1,79 @@
 package cache_adapters
 
-import "server/external/message"
+import (
+	"errors"
+	"server/external/message"
+	"storage/external/event"
+	"time"
+)
 
+// CacheRepository keeps pages of the newest messages of every chat in front of db,
+// ok returned by getters is false if cache has no complete answer and db must be asked
 type CacheRepository interface {
-	AddMessage(message.Message, int64)
-	CheckLastMsgTimeStamp(string, int64) (bool, error)
+	AddMessage(message.Message) // called for every stored message
+	CheckLastMsgId(int, int64) (bool, error)
+	SetMessages(int, []message.Message) error
+	GetLastKMessages(int, int) ([]message.Message, bool, error)
+	GetNewerMessages(int, int64, int) ([]message.Message, bool, error)
+	InvalidateChat(int) error
 	CloseRepo() error
 }
+
+type Kind string
+
+const (
+	KindRedis  Kind = "redis"
+	KindMemory Kind = "memory" // in-process lru, for dev and tests without redis
+)
+
+var ErrorUnknownKind error = errors.New("unknown cache kind, expected redis or memory")
+
+// zero limits mean no limit, except MaxMessages which falls back to default one
+type Config struct {
+	Kind        Kind
+	TTL         time.Duration // chat page is dropped if it was not written for so long
+	MaxMessages int           // newest messages kept per chat
+	MaxBytes    int           // encoded size of messages kept per chat
+	MaxChats    int           // chats kept by memory cache, least recently used ones are evicted
+}
+
+var DefaultConfig = Config{Kind: KindRedis, TTL: 24 * time.Hour, MaxMessages: 200, MaxBytes: 256 << 10, MaxChats: 10000}
+
+func ParseKind(s string) (Kind, error) {
+	switch k := Kind(s); k {
+	case KindRedis, KindMemory:
+		return k, nil
+	}
+	return "", ErrorUnknownKind
+}
+
+// size of message which is counted against MaxBytes, the same for every implementation
+func MessageSize(msg message.Message) int {
+	return len(event.EncodePersistedMessage(msg))
+}
+
+// message ids of a chat go one by one, so cached ones have no gaps only if each id differs from the previous by one
+func Contiguous(msgs []message.Message) bool {
+	for i := 1; i < len(msgs); i++ {
+		d := msgs[i].GetId() - msgs[i-1].GetId()
+		if d != 1 && d != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// checks k newest cached messages sorted from newer to older, the newest must be the last message of chat,
+// so an old page put to cache after the newer one expired is not taken for the newest one.
+// fewer than k are enough only if chat has no older ones
+func CompleteLast(msgs []message.Message, k int, lastId int64) bool {
+	if len(msgs) == 0 || msgs[0].GetId() != lastId || !Contiguous(msgs) {
+		return false
+	}
+	return len(msgs) >= k || msgs[len(msgs)-1].GetId() == 1
+}
+
+// checks cached messages newer than lMsgId sorted from older to newer, they must start right after lMsgId
+func CompleteNewer(msgs []message.Message, lMsgId int64) bool {
+	return len(msgs) > 0 && msgs[0].GetId() == max(lMsgId, 0)+1 && Contiguous(msgs)
+}
@@ -0,0 +1,162 @@
+package memoryrepo
+
+import (
+	"cmp"
+	"container/list"
+	"server/external/message"
+	"slices"
+	"storage/internal/cache_adapters"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type page struct {
+	cId     int
+	msgs    []message.Message // sorted by id
+	sizes   []int             // encoded size of every message in msgs
+	bytes   int
+	expires time.Time
+}
+
+// MemoryRepo keeps chat pages in process, the least recently used chats are evicted when MaxChats is reached,
+// last message ids are kept for every chat like redis does
+type MemoryRepo struct {
+	cfg     cache_adapters.Config
+	pages   map[int]*list.Element
+	lru     *list.List // front is the most recently used page
+	lastIds map[int]int64
+	mu      *sync.Mutex
+	lg      *zap.Logger
+}
+
+func NewRepo(cfg cache_adapters.Config, lg *zap.Logger) *MemoryRepo {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = cache_adapters.DefaultConfig.MaxMessages
+	}
+	return &MemoryRepo{cfg: cfg, pages: make(map[int]*list.Element), lru: list.New(), lastIds: make(map[int]int64), mu: &sync.Mutex{}, lg: lg.With(zap.String("adapters", "memory cache"))}
+}
+
+func (mr *MemoryRepo) AddMessage(msg message.Message) {
+	mr.SetMessages(msg.GetChatId(), []message.Message{msg})
+}
+
+// return true if there are unread messages, false otherwise
+func (mr *MemoryRepo) CheckLastMsgId(cId int, lMsgId int64) (bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.lastIds[cId] > lMsgId, nil
+}
+
+// returns live page of chat and marks it as recently used, expired page is dropped, mu must be held
+func (mr *MemoryRepo) getPage(cId int) *page {
+	el, ok := mr.pages[cId]
+	if !ok {
+		return nil
+	}
+	p := el.Value.(*page)
+	if mr.cfg.TTL > 0 && time.Now().After(p.expires) {
+		mr.removePage(el)
+		return nil
+	}
+	mr.lru.MoveToFront(el)
+	return p
+}
+
+func (mr *MemoryRepo) removePage(el *list.Element) {
+	mr.lru.Remove(el)
+	delete(mr.pages, el.Value.(*page).cId)
+}
+
+// stored messages only are expected, so they may move the last id of chat
+func (mr *MemoryRepo) SetMessages(cId int, msgs []message.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	p := mr.getPage(cId)
+	if p == nil {
+		p = &page{cId: cId}
+		mr.pages[cId] = mr.lru.PushFront(p)
+	}
+	for _, msg := range msgs {
+		mr.lastIds[cId] = max(mr.lastIds[cId], msg.GetId())
+		size := cache_adapters.MessageSize(msg)
+		i, found := slices.BinarySearchFunc(p.msgs, msg.GetId(), func(m message.Message, id int64) int { return cmp.Compare(m.GetId(), id) })
+		if found {
+			p.bytes += size - p.sizes[i]
+			p.msgs[i], p.sizes[i] = msg, size
+			continue
+		}
+		p.msgs = slices.Insert(p.msgs, i, msg)
+		p.sizes = slices.Insert(p.sizes, i, size)
+		p.bytes += size
+	}
+
+	drop := 0
+	for drop < len(p.msgs) && (len(p.msgs)-drop > mr.cfg.MaxMessages || (mr.cfg.MaxBytes > 0 && p.bytes > mr.cfg.MaxBytes)) {
+		p.bytes -= p.sizes[drop]
+		drop++
+	}
+	p.msgs = slices.Delete(p.msgs, 0, drop)
+	p.sizes = slices.Delete(p.sizes, 0, drop)
+	p.expires = time.Now().Add(mr.cfg.TTL)
+
+	for mr.cfg.MaxChats > 0 && mr.lru.Len() > mr.cfg.MaxChats {
+		mr.removePage(mr.lru.Back())
+	}
+	return nil
+}
+
+func (mr *MemoryRepo) InvalidateChat(cId int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if el, ok := mr.pages[cId]; ok {
+		mr.removePage(el)
+	}
+	return nil
+}
+
+// returns k newest cached messages from newer to older
+func (mr *MemoryRepo) GetLastKMessages(cId int, k int) ([]message.Message, bool, error) {
+	if k <= 0 {
+		return []message.Message{}, true, nil
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	p := mr.getPage(cId)
+	if p == nil {
+		return nil, false, nil
+	}
+
+	msgs := slices.Clone(p.msgs[max(len(p.msgs)-k, 0):])
+	slices.Reverse(msgs)
+	if !cache_adapters.CompleteLast(msgs, k, mr.lastIds[cId]) {
+		return nil, false, nil
+	}
+	return msgs, true, nil
+}
+
+// returns at most limit cached messages newer than lMsgId from older to newer
+func (mr *MemoryRepo) GetNewerMessages(cId int, lMsgId int64, limit int) ([]message.Message, bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	p := mr.getPage(cId)
+	if p == nil {
+		return nil, false, nil
+	}
+
+	i, _ := slices.BinarySearchFunc(p.msgs, lMsgId+1, func(m message.Message, id int64) int { return cmp.Compare(m.GetId(), id) })
+	msgs := slices.Clone(p.msgs[i:min(i+limit, len(p.msgs))])
+	if !cache_adapters.CompleteNewer(msgs, lMsgId) {
+		return nil, false, nil
+	}
+	return msgs, true, nil
+}
+
+func (mr *MemoryRepo) CloseRepo() error {
+	return nil
+}
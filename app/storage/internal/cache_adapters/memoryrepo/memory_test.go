@@ -0,0 +1,214 @@
+package memoryrepo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"server/external/message"
+	"storage/internal/cache_adapters"
+
+	"go.uber.org/zap"
+)
+
+func newMessage(cId int, id int64) message.Message {
+	msg := message.Message{User: "tester", Text: "text"}
+	msg.SetChatId(cId)
+	msg.SetId(id)
+	return msg
+}
+
+// messages of chat with ids in [from, to]
+func newMessages(cId int, from int64, to int64) []message.Message {
+	msgs := make([]message.Message, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		msgs = append(msgs, newMessage(cId, id))
+	}
+	return msgs
+}
+
+func ids(msgs []message.Message) []int64 {
+	res := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, msg.GetId())
+	}
+	return res
+}
+
+func equalIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestContiguousAndCompleteLast(t *testing.T) {
+	tests := []struct {
+		name       string
+		ids        []int64 // from newer to older
+		k          int
+		lastId     int64
+		contiguous bool
+		complete   bool
+	}{
+		{"empty", nil, 3, 0, true, false},
+		{"k newest", []int64{10, 9, 8}, 3, 10, true, true},
+		{"more than k", []int64{10, 9, 8, 7}, 3, 10, true, true},
+		{"fewer than k without older ones", []int64{2, 1}, 3, 2, true, true},
+		{"fewer than k with older ones", []int64{10, 9}, 3, 10, true, false},
+		{"gap", []int64{10, 8, 7}, 3, 10, false, false},
+		{"older than last message", []int64{10, 9, 8}, 3, 15, true, false},
+		{"last id is unknown", []int64{10, 9, 8}, 3, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := make([]message.Message, 0, len(tt.ids))
+			for _, id := range tt.ids {
+				msgs = append(msgs, newMessage(1, id))
+			}
+			if got := cache_adapters.Contiguous(msgs); got != tt.contiguous {
+				t.Errorf("Contiguous = %v, want %v", got, tt.contiguous)
+			}
+			if got := cache_adapters.CompleteLast(msgs, tt.k, tt.lastId); got != tt.complete {
+				t.Errorf("CompleteLast = %v, want %v", got, tt.complete)
+			}
+		})
+	}
+}
+
+func TestPageLimits(t *testing.T) {
+	size := cache_adapters.MessageSize(newMessage(1, 1)) // ids are small, so every message has the same size
+	tests := []struct {
+		name     string
+		cfg      cache_adapters.Config
+		set      []message.Message
+		k        int
+		wantIds  []int64
+		complete bool
+	}{
+		{"no limits", cache_adapters.Config{MaxMessages: 100}, newMessages(1, 1, 5), 10, []int64{5, 4, 3, 2, 1}, true},
+		{"max messages drops the oldest", cache_adapters.Config{MaxMessages: 3}, newMessages(1, 1, 5), 3, []int64{5, 4, 3}, true},
+		{"not enough cached after drop", cache_adapters.Config{MaxMessages: 3}, newMessages(1, 1, 5), 4, nil, false},
+		{"byte cap drops the oldest", cache_adapters.Config{MaxMessages: 100, MaxBytes: 2 * size}, newMessages(1, 1, 5), 2, []int64{5, 4}, true},
+		{"byte cap below one message", cache_adapters.Config{MaxMessages: 100, MaxBytes: size - 1}, newMessages(1, 1, 2), 1, nil, false},
+		{"replaced message is counted once", cache_adapters.Config{MaxMessages: 100, MaxBytes: 2 * size}, append(newMessages(1, 1, 2), newMessage(1, 2)), 2, []int64{2, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := NewRepo(tt.cfg, zap.NewNop())
+			mr.SetMessages(1, tt.set)
+			msgs, ok, err := mr.GetLastKMessages(1, tt.k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.complete || !equalIds(ids(msgs), tt.wantIds) {
+				t.Fatalf("got %v, %v, want %v, %v", ids(msgs), ok, tt.wantIds, tt.complete)
+			}
+			if tt.cfg.MaxBytes > 0 {
+				if p := mr.getPage(1); p != nil && p.bytes > tt.cfg.MaxBytes {
+					t.Fatalf("page has %d bytes, cap is %d", p.bytes, tt.cfg.MaxBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastRecentlyUsedChatIsEvicted(t *testing.T) {
+	type touch struct {
+		cId   int
+		write bool
+	}
+	tests := []struct {
+		name    string
+		touches []touch // done in this order after chats 1, 2 and 3 are written
+		evicted int
+	}{
+		{"the oldest written", nil, 1},
+		{"read moves chat to front", []touch{{1, false}}, 2},
+		{"written moves chat to front", []touch{{1, true}, {2, true}}, 3},
+		{"read and written", []touch{{2, false}, {1, true}}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := NewRepo(cache_adapters.Config{MaxMessages: 10, MaxChats: 3}, zap.NewNop())
+			for cId := 1; cId <= 3; cId++ {
+				mr.SetMessages(cId, newMessages(cId, 1, 2))
+			}
+			for _, tc := range tt.touches {
+				if tc.write {
+					mr.AddMessage(newMessage(tc.cId, 3))
+				} else {
+					mr.GetLastKMessages(tc.cId, 1)
+				}
+			}
+			mr.SetMessages(4, newMessages(4, 1, 2))
+
+			for cId := 1; cId <= 4; cId++ {
+				_, ok, _ := mr.GetNewerMessages(cId, 0, 10)
+				if ok == (cId == tt.evicted) {
+					t.Fatalf("chat %d is cached: %v, evicted chat must be %d", cId, ok, tt.evicted)
+				}
+			}
+			if newer, _ := mr.CheckLastMsgId(tt.evicted, 1); !newer {
+				t.Fatal("last id of evicted chat is lost")
+			}
+		})
+	}
+}
+
+func TestPageExpires(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	mr := NewRepo(cache_adapters.Config{MaxMessages: 10, TTL: ttl}, zap.NewNop())
+	mr.SetMessages(1, newMessages(1, 1, 3))
+	mr.SetMessages(2, newMessages(2, 1, 3))
+	if _, ok, _ := mr.GetLastKMessages(1, 3); !ok {
+		t.Fatal("fresh page is not served")
+	}
+
+	time.Sleep(ttl * 2 / 3)
+	mr.AddMessage(newMessage(2, 4)) // write extends ttl of page, read doesn't
+	mr.GetLastKMessages(1, 3)
+	time.Sleep(ttl * 2 / 3) // page 1 is expired by ttl / 3, page 2 lives for ttl / 3 more
+
+	if _, ok, _ := mr.GetLastKMessages(1, 3); ok {
+		t.Fatal("expired page is served")
+	}
+	if _, ok, _ := mr.GetNewerMessages(1, 0, 10); ok {
+		t.Fatal("expired page is served")
+	}
+	if msgs, ok, _ := mr.GetLastKMessages(2, 4); !ok || !equalIds(ids(msgs), []int64{4, 3, 2, 1}) {
+		t.Fatalf("page written within ttl is not served, got %v", ids(msgs))
+	}
+	if newer, _ := mr.CheckLastMsgId(1, 2); !newer {
+		t.Fatal("last id of expired chat is lost")
+	}
+}
+
+func TestGetNewerMessages(t *testing.T) {
+	mr := NewRepo(cache_adapters.Config{MaxMessages: 5}, zap.NewNop())
+	mr.SetMessages(1, newMessages(1, 1, 8)) // 4..8 are kept
+	tests := []struct {
+		lMsgId  int64
+		limit   int
+		wantIds []int64
+		ok      bool
+	}{
+		{3, 10, []int64{4, 5, 6, 7, 8}, true},
+		{5, 2, []int64{6, 7}, true},
+		{2, 10, nil, false}, // 3 was dropped
+		{8, 10, nil, false}, // nothing newer is cached, db knows if there is anything
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("after %d", tt.lMsgId), func(t *testing.T) {
+			msgs, ok, err := mr.GetNewerMessages(1, tt.lMsgId, tt.limit)
+			if err != nil || ok != tt.ok || !equalIds(ids(msgs), tt.wantIds) {
+				t.Fatalf("got %v, %v, %v, want %v, %v", ids(msgs), ok, err, tt.wantIds, tt.ok)
+			}
+		})
+	}
+}
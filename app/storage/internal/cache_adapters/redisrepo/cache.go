@@ -0,0 +1,161 @@
+package redisrepo
+
+import (
+	"fmt"
+	"server/external/message"
+	"storage/external/event"
+	"storage/internal/cache_adapters"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// sorted set of encoded persisted messages scored by message id
+func pageKey(cId int) string {
+	return fmt.Sprintf("chat:%d:recent", cId)
+}
+
+// encoded size of messages in page, it is changed only together with the page
+func pageBytesKey(cId int) string {
+	return fmt.Sprintf("chat:%d:recent:bytes", cId)
+}
+
+// the biggest id of chat messages, only grows, it has no ttl since it tells if db has to be asked at all
+func lastIdKey(cId int) string {
+	return strconv.Itoa(cId)
+}
+
+// KEYS: page, page bytes, last id; ARGV: max messages, max bytes, ttl ms, then id and encoded message pairs.
+// message replaces cached one with the same id, the oldest ones are dropped till page fits limits,
+// last id is set to the biggest one if it is bigger, everything is done atomically in one call
+var setMessagesScript = redis.NewScript(`
+local size = tonumber(redis.call('GET', KEYS[2]) or '0')
+local maxId = 0
+for i = 4, #ARGV, 2 do
+	maxId = math.max(maxId, tonumber(ARGV[i]))
+	for _, m in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[i], ARGV[i])) do
+		size = size - #m
+	end
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], ARGV[i], ARGV[i])
+	redis.call('ZADD', KEYS[1], ARGV[i], ARGV[i + 1])
+	size = size + #ARGV[i + 1]
+end
+
+local maxMsgs, maxBytes, ttl = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+while true do
+	local n = redis.call('ZCARD', KEYS[1])
+	if n == 0 then
+		size = 0
+		break
+	end
+	if (maxMsgs <= 0 or n <= maxMsgs) and (maxBytes <= 0 or size <= maxBytes) then
+		break
+	end
+	local oldest = redis.call('ZPOPMIN', KEYS[1])
+	size = size - #oldest[1]
+end
+
+redis.call('SET', KEYS[2], size)
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+
+if maxId > tonumber(redis.call('GET', KEYS[3]) or '0') then
+	redis.call('SET', KEYS[3], maxId)
+end
+return size
+`)
+
+// stored messages only are expected, so they may move the last id of chat
+func (rr *RedisRepo) SetMessages(cId int, msgs []message.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	args := make([]any, 0, 3+2*len(msgs))
+	args = append(args, rr.cfg.MaxMessages, rr.cfg.MaxBytes, rr.cfg.TTL.Milliseconds())
+	for _, msg := range msgs {
+		args = append(args, msg.GetId(), event.EncodePersistedMessage(msg))
+	}
+	err := setMessagesScript.Run(rr.ctx, rr.client.Load(), []string{pageKey(cId), pageBytesKey(cId), lastIdKey(cId)}, args...).Err()
+	if err != nil {
+		rr.lg.Warn("Failed to set cached messages", zap.Error(err), zap.Int("chat id", cId), zap.Int("msgs amount", len(msgs)))
+	}
+	return err
+}
+
+func (rr *RedisRepo) InvalidateChat(cId int) error {
+	if err := rr.client.Load().Del(rr.ctx, pageKey(cId), pageBytesKey(cId)).Err(); err != nil {
+		rr.lg.Warn("Failed to invalidate cached chat", zap.Error(err), zap.Int("chat id", cId))
+		return err
+	}
+	return nil
+}
+
+func decodePage(zs []redis.Z) ([]message.Message, error) {
+	msgs := make([]message.Message, 0, len(zs))
+	for _, z := range zs {
+		member, ok := z.Member.(string)
+		if !ok {
+			return nil, event.ErrorMalformedEvent
+		}
+		msg, err := event.DecodePersistedMessage([]byte(member))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// returns k newest cached messages from newer to older, page is read together with last id of chat
+func (rr *RedisRepo) GetLastKMessages(cId int, k int) ([]message.Message, bool, error) {
+	if k <= 0 {
+		return []message.Message{}, true, nil
+	}
+	var lastId *redis.StringCmd
+	var page *redis.ZSliceCmd
+	rr.client.Load().TxPipelined(rr.ctx, func(pipe redis.Pipeliner) error { // errors are kept by commands
+		lastId = pipe.Get(rr.ctx, lastIdKey(cId))
+		page = pipe.ZRevRangeWithScores(rr.ctx, pageKey(cId), 0, int64(k-1))
+		return nil
+	})
+	zs, err := page.Result()
+	if err != nil {
+		rr.lg.Warn("Failed to get cached messages", zap.Error(err), zap.Int("chat id", cId))
+		return nil, false, err
+	}
+	msgs, err := decodePage(zs)
+	if err != nil {
+		rr.lg.Warn("Failed to decode cached messages", zap.Error(err), zap.Int("chat id", cId))
+		return nil, false, err
+	}
+	lId, _ := lastId.Int64() // page without last id is never complete
+	if !cache_adapters.CompleteLast(msgs, k, lId) {
+		return nil, false, nil
+	}
+	return msgs, true, nil
+}
+
+// returns at most limit cached messages newer than lMsgId from older to newer
+func (rr *RedisRepo) GetNewerMessages(cId int, lMsgId int64, limit int) ([]message.Message, bool, error) {
+	zs, err := rr.client.Load().ZRangeByScoreWithScores(rr.ctx, pageKey(cId), &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatInt(lMsgId, 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		rr.lg.Warn("Failed to get cached messages", zap.Error(err), zap.Int("chat id", cId), zap.Int64("last message id", lMsgId))
+		return nil, false, err
+	}
+	msgs, err := decodePage(zs)
+	if err != nil {
+		rr.lg.Warn("Failed to decode cached messages", zap.Error(err), zap.Int("chat id", cId))
+		return nil, false, err
+	}
+	if !cache_adapters.CompleteNewer(msgs, lMsgId) {
+		return nil, false, nil
+	}
+	return msgs, true, nil
+}
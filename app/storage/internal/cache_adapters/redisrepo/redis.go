@@ -2,97 +2,144 @@ package redisrepo
 
 import (
 	"context"
-	"fmt"
-	"math/rand"
 	"server/external/message" // можно было, конечно полностью отделить логику от message - но там и так красивый интерфейс, так что не думаю, что это было бы хорошо, тк код выглядел бы тогда менее красиво
+	"storage/internal/cache_adapters"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
+// messages added by consumer are written by a fixed amount of workers, writes of the same chat queued together
+// are sent in one script call
+const (
+	Workers       = 8
+	QueueSize     = 1024
+	MaxWriteBatch = 128
+)
+
+const ReconnectTimeout = 5 * time.Second
+
 type RedisRepo struct {
-	client *redis.Client
-	ctx    context.Context
-	lg     *zap.Logger
-	mu     sync.Mutex
+	client   *atomic.Pointer[redis.Client] // replaced by Reconnect
+	switched *atomic.Bool                  // set once repo is reconnected to redis which may lack last ids
+	cfg      cache_adapters.Config
+	queue    chan message.Message
+	done     chan struct{}
+	wg       *sync.WaitGroup
+	ctx      context.Context
+	lg       *zap.Logger
 }
 
-func NewRepo(dbAddr string, ctx context.Context, lg *zap.Logger) *RedisRepo {
-	client := redis.NewClient(&redis.Options{
+func NewRepo(dbAddr string, cfg cache_adapters.Config, ctx context.Context, lg *zap.Logger) *RedisRepo {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = cache_adapters.DefaultConfig.MaxMessages
+	}
+	rr := &RedisRepo{client: &atomic.Pointer[redis.Client]{}, switched: &atomic.Bool{}, cfg: cfg, queue: make(chan message.Message, QueueSize), done: make(chan struct{}), wg: &sync.WaitGroup{}, ctx: ctx, lg: lg.With(zap.String("adapters", "redis cache"))}
+	rr.client.Store(newClient(dbAddr))
+	for i := 0; i < Workers; i++ {
+		rr.wg.Add(1)
+		go rr.runWorker()
+	}
+	return rr
+}
+
+func newClient(dbAddr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:     dbAddr,
 		Password: "",
 		DB:       0,
 	})
-	return &RedisRepo{client: client, ctx: ctx, lg: lg.With(zap.String("adapters", "redis cache")), mu: sync.Mutex{}}
-}
-
-type txContext struct {
-	key         string
-	val         int64
-	valIsActual bool
-	ctx         context.Context
 }
 
-func (tc *txContext) addMessageTransaction(tx *redis.Tx) error {
-	val, err := tx.Get(tc.ctx, tc.key).Int64()
-	if err != nil && err != redis.Nil {
+// switches repo to another redis, the old client is kept if the new one can't be reached
+func (rr *RedisRepo) Reconnect(dbAddr string) error {
+	client := newClient(dbAddr)
+	ctx, cncl := context.WithTimeout(rr.ctx, ReconnectTimeout)
+	defer cncl()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		rr.lg.Error("Failed to reconnect to redis", zap.Error(err), zap.String("addr", dbAddr))
 		return err
 	}
-	if val >= tc.val {
-		tc.valIsActual = false
-		return nil
+	rr.switched.Store(true)
+	if err := rr.client.Swap(client).Close(); err != nil { // commands in progress fail and are treated like cache misses
+		rr.lg.Warn("Failed to close previous redis client", zap.Error(err))
 	}
-
-	_, err = tx.TxPipelined(tc.ctx, func(pipe redis.Pipeliner) error {
-		pipe.Set(tc.ctx, tc.key, fmt.Sprint(tc.val), 0)
-		return nil
-	})
-	return err
+	rr.lg.Info("Reconnected to redis", zap.String("addr", dbAddr))
+	return nil
 }
 
-func (rr *RedisRepo) AddMessage(msg message.Message, lMsgTmSt int64) {
-	go func() {
-		rr.mu.Lock()
-		defer rr.mu.Unlock()
+// message is put to page of its chat and its id becomes the last one of chat if it is bigger,
+// it blocks while queue is full, so consumer is slowed down instead of spawning goroutines
+func (rr *RedisRepo) AddMessage(msg message.Message) {
+	select {
+	case rr.queue <- msg:
+	case <-rr.done:
+	case <-rr.ctx.Done():
+	}
+}
 
-		cId := strconv.Itoa(msg.GetChatId())
-		txc := txContext{cId, lMsgTmSt, true, rr.ctx}
+// takes already queued messages along with msg and writes them chat by chat
+func (rr *RedisRepo) writeQueued(msg message.Message) {
+	byChat := map[int][]message.Message{msg.GetChatId(): {msg}}
+drain:
+	for n := 1; n < MaxWriteBatch; n++ {
+		select {
+		case m := <-rr.queue:
+			byChat[m.GetChatId()] = append(byChat[m.GetChatId()], m)
+		default:
+			break drain
+		}
+	}
+	for cId, msgs := range byChat {
+		rr.SetMessages(cId, msgs)
+	}
+}
 
-		timeTck := time.NewTicker(time.Duration(rand.Intn(100)) * time.Millisecond)
-		defer timeTck.Stop()
-		for txc.valIsActual {
-			select {
-			case <-(*timeTck).C:
-				err := rr.client.Watch(rr.ctx, txc.addMessageTransaction, cId)
-				if err == nil {
+// queue is drained after close, so messages added before it are not lost
+func (rr *RedisRepo) runWorker() {
+	defer rr.wg.Done()
+	for {
+		select {
+		case msg := <-rr.queue:
+			rr.writeQueued(msg)
+		case <-rr.ctx.Done():
+			return
+		case <-rr.done:
+			for {
+				select {
+				case msg := <-rr.queue:
+					rr.writeQueued(msg)
+				default:
 					return
 				}
-				if err != redis.TxFailedErr {
-					rr.lg.Warn("Failed to add message, got unexpected err", zap.Error(err), zap.String("conf id", cId), zap.Int("user id", msg.GetUserId()))
-				}
-			case <-rr.ctx.Done():
-				return
 			}
 		}
-		rr.lg.Debug("Successfully add last message time stamp")
-	}()
+	}
 }
 
-// return true if there are unread messages, false otherwise
-func (rr *RedisRepo) CheckLastMsgTimeStamp(cId string, msgTimeStamp int64) (bool, error) {
-	lSaved, err := rr.client.Get(rr.ctx, cId).Int64()
+// return true if there are unread messages, false otherwise,
+// after reconnect a chat without last id may have messages written before, so db is asked for it
+func (rr *RedisRepo) CheckLastMsgId(cId int, lMsgId int64) (bool, error) {
+	lSaved, err := rr.client.Load().Get(rr.ctx, strconv.Itoa(cId)).Int64()
+	if err == redis.Nil && rr.switched.Load() {
+		return true, nil
+	}
 	if err != nil && err != redis.Nil {
-		rr.lg.Warn("Failed to check last message time stamp", zap.Error(err), zap.String("conf id", cId))
+		rr.lg.Warn("Failed to check last message id", zap.Error(err), zap.Int("conf id", cId))
 		return false, err
 	}
-	return lSaved > msgTimeStamp, nil
+	return lSaved > lMsgId, nil
 }
 
 func (rr *RedisRepo) CloseRepo() error {
-	if err := rr.client.Close(); err != nil {
+	close(rr.done)
+	rr.wg.Wait()
+	if err := rr.client.Load().Close(); err != nil {
 		rr.lg.Error("Failed to close cache repo", zap.Error(err))
 		return err
 	}
@@ -0,0 +1,92 @@
+package redisrepo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"server/external/message"
+	"storage/internal/cache_adapters"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const benchChats = 100
+
+// benchmarks write to redis given by CHAT_TEST_REDIS, keys of chats no other run uses are written and removed after it
+func benchRedisAddr(b *testing.B) string {
+	addr := os.Getenv("CHAT_TEST_REDIS")
+	if addr == "" {
+		b.Skip("CHAT_TEST_REDIS is not set")
+	}
+	client := newClient(addr)
+	defer client.Close()
+	ctx, cncl := context.WithTimeout(context.Background(), ReconnectTimeout)
+	defer cncl()
+	if err := client.Ping(ctx).Err(); err != nil {
+		b.Skipf("redis is unavailable: %v", err)
+	}
+	return addr
+}
+
+func cleanChats(b *testing.B, addr string, firstChat int) {
+	client := newClient(addr)
+	defer client.Close()
+	for cId := firstChat; cId < firstChat+benchChats; cId++ {
+		if err := client.Del(context.Background(), pageKey(cId), pageBytesKey(cId), lastIdKey(cId)).Err(); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+// message n of a run, messages of every chat get consecutive ids like they do from consumer
+func benchMessage(firstChat int, n int64) message.Message {
+	msg := message.Message{User: "bench", Text: fmt.Sprintf("bench message %d", n)}
+	msg.SetChatId(firstChat + int(n%benchChats))
+	msg.SetId(n/benchChats + 1)
+	return msg
+}
+
+// every op is one message added by concurrent producers, pool is the way consumer adds messages through Workers,
+// direct calls the script for every message from the producer itself to show what the pool saves,
+// the same does cmd/cachebench for a fixed amount of messages
+func BenchmarkAddMessage(b *testing.B) {
+	addr := benchRedisAddr(b)
+	cfg := cache_adapters.DefaultConfig
+
+	b.Run("pool", func(b *testing.B) {
+		firstChat := int(time.Now().UnixNano() % (1 << 30))
+		defer cleanChats(b, addr, firstChat)
+		rr := NewRepo(addr, cfg, context.Background(), zap.NewNop())
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rr.AddMessage(benchMessage(firstChat, next.Add(1)-1))
+			}
+		})
+		if err := rr.CloseRepo(); err != nil { // waits for queued writes
+			b.Fatal(err)
+		}
+	})
+
+	b.Run("direct", func(b *testing.B) {
+		firstChat := int(time.Now().UnixNano() % (1 << 30))
+		defer cleanChats(b, addr, firstChat)
+		rr := NewRepo(addr, cfg, context.Background(), zap.NewNop())
+		defer rr.CloseRepo()
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				msg := benchMessage(firstChat, next.Add(1)-1)
+				if err := rr.SetMessages(msg.GetChatId(), []message.Message{msg}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -5,7 +5,11 @@ import (
 	"strings"
 
 	"server/external/adapters"
+	"server/external/adapters/postgresrepo"
 	"server/external/message"
+	"storage/external/deadletter"
+	"storage/external/event"
+	"storage/external/producer"
 	"storage/internal/cache_adapters"
 	"storage/internal/kafka"
 
@@ -23,35 +27,90 @@ func initConsumerConfig() *sarama.Config {
 }
 
 type MessageHandler struct {
-	Ctx context.Context
-	Db  adapters.Repository
-	Cdb cache_adapters.CacheRepository
-	Eg  *errgroup.Group
-	Lg  *zap.Logger
+	Ctx       context.Context
+	Db        adapters.Repository
+	Bdb       adapters.BatchRepository
+	BatchMode adapters.BatchMode
+	Cdb       cache_adapters.CacheRepository
+	Np        *producer.Producer // notifies servers about persisted messages, nil if they only poll
+	Eg        *errgroup.Group
+	Lg        *zap.Logger
 }
 
-func NewMessageHandler(ctx context.Context, db adapters.Repository, cdb cache_adapters.CacheRepository, eg *errgroup.Group, lg *zap.Logger) *MessageHandler {
-	return &MessageHandler{ctx, db, cdb, eg, lg}
+func NewMessageHandler(ctx context.Context, db adapters.Repository, bdb adapters.BatchRepository, mode adapters.BatchMode, cdb cache_adapters.CacheRepository, np *producer.Producer, eg *errgroup.Group, lg *zap.Logger) *MessageHandler {
+	return &MessageHandler{ctx, db, bdb, mode, cdb, np, eg, lg}
+}
+
+func (mh *MessageHandler) decodeMessage(mb *sarama.ConsumerMessage) (message.Message, error) {
+	msg, err := event.DecodeRecord(mb.Headers, mb.Value)
+	if err != nil {
+		mh.Lg.Warn("Failed to decode message", zap.Error(err), zap.Time("msg time stamp", mb.Timestamp))
+		return message.Message{}, kafka.Permanent(err)
+	}
+	if msg.GetEventId() == "" { // legacy records are deduplicated by their position in topic
+		msg.SetEventId(event.RecordEventId(mb.Topic, mb.Partition, mb.Offset))
+	}
+	return msg, nil
+}
+
+// outage of postgres is not a fault of record, so consumer waits for it instead of dead lettering records
+func storeError(err error) error {
+	if postgresrepo.IsUnavailable(err) {
+		return kafka.Unavailable(err)
+	}
+	return err
+}
+
+// redelivered record gets id of the stored message, so it is cached and notified again harmlessly
+func (mh *MessageHandler) messageStored(msg message.Message) {
+	mh.Cdb.AddMessage(msg)
+	if mh.Np != nil {
+		mh.Np.WriteMessage(event.EncodePersistedMessage(msg), nil, event.Headers()...)
+	}
+	mh.Lg.Debug("Successfully added msg to db", zap.Int64("message id", msg.GetId()), zap.Int("user id", msg.GetUserId()), zap.Int("chat id", msg.GetChatId()))
 }
 
 func (mh *MessageHandler) handleMessage(mb *sarama.ConsumerMessage) error {
-	msg, err := message.DecodeMsgFromBytes(mb.Value)
+	msg, err := mh.decodeMessage(mb)
 	if err != nil {
-		mh.Lg.Warn("Failed to decode message", zap.Time("msg time stamp", mb.Timestamp))
 		return err
 	}
-	mh.Cdb.AddMessage(msg, mb.Timestamp.UnixMilli())
-	if err := mh.Db.AddMessage(msg); err != nil {
+	if err := mh.Db.AddMessage(&msg, nil); err != nil {
 		mh.Lg.Error("Failed to add msg to db")
-		return err
+		return storeError(err)
 	}
-	mh.Lg.Debug("Successfully added msg to db", zap.Int("user id", msg.GetUserId()), zap.Int("chat id", msg.GetChatId()))
+	mh.messageStored(msg)
+	return nil
+}
 
+// any broken record fails the batch, so it is found when records are handled one by one
+func (mh *MessageHandler) handleBatch(mbs []*sarama.ConsumerMessage) error {
+	msgs := make([]message.Message, 0, len(mbs))
+	for _, mb := range mbs {
+		msg, err := mh.decodeMessage(mb)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := mh.Bdb.AddMessages(msgs, mh.BatchMode); err != nil {
+		mh.Lg.Error("Failed to add msgs batch to db", zap.Int("batch size", len(msgs)))
+		return storeError(err)
+	}
+	for _, msg := range msgs {
+		mh.messageStored(msg)
+	}
 	return nil
 }
 
-func RunConsumer(ctx context.Context, msgHandler *MessageHandler, brokers string, group string, topics string) (sarama.ConsumerGroup, error) {
-	cons := kafka.NewConsumer(msgHandler.handleMessage)
+// records failed after retries go to dead letter topic instead of stopping the consumer,
+// in batch mode records are stored batch by batch
+func RunConsumer(ctx context.Context, msgHandler *MessageHandler, brokers string, group string, topics string, dlq *deadletter.Writer, retry kafka.RetryConfig, batch kafka.BatchConfig) (sarama.ConsumerGroup, error) {
+	var batchHandler kafka.BatchHandlerFunc
+	if msgHandler.Bdb != nil && msgHandler.BatchMode != adapters.BatchSingle {
+		batchHandler = msgHandler.handleBatch
+	}
+	cons := kafka.NewConsumer(msgHandler.handleMessage, batchHandler, dlq.Write, retry, batch, msgHandler.Lg.With(zap.String("storage", "consumer")))
 	consGroup, err := sarama.NewConsumerGroup(strings.Split(brokers, ","), group, initConsumerConfig())
 	if err != nil {
 		msgHandler.Lg.Error("Failed to init consumer group", zap.String("brokers", brokers), zap.String("group", group))
@@ -0,0 +1,149 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"server/external/adapters"
+	"server/external/adapters/postgresrepo"
+	"server/external/message"
+	"storage/external/event"
+	"storage/internal/cache_adapters"
+	"storage/internal/cache_adapters/memoryrepo"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// tests are run against database given by CHAT_TEST_POSTGRES, its schema is migrated, every test writes to its own chat
+func newTestHandler(t *testing.T, mode adapters.BatchMode) (*MessageHandler, *postgresrepo.PostgresRepo) {
+	dbAddr := os.Getenv("CHAT_TEST_POSTGRES")
+	if dbAddr == "" {
+		t.Skip("CHAT_TEST_POSTGRES is not set")
+	}
+	ctx, cncl := context.WithCancel(context.Background())
+	t.Cleanup(cncl)
+	lg := zap.NewNop()
+
+	mg, err := postgresrepo.NewMigrator(ctx, dbAddr, lg)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %v", err)
+	}
+	_, err = mg.Up(ctx, 0)
+	mg.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := postgresrepo.NewRepo(dbAddr, ctx, lg)
+	t.Cleanup(func() { db.CloseRepo() })
+	eg, _ := errgroup.WithContext(ctx)
+	return NewMessageHandler(ctx, db, db, mode, memoryrepo.NewRepo(cache_adapters.DefaultConfig, lg), nil, eg, lg), db
+}
+
+func testChatId() int {
+	return int(time.Now().UnixNano() % (1 << 30))
+}
+
+func newRecords(cId int, amt int) []*sarama.ConsumerMessage {
+	mbs := make([]*sarama.ConsumerMessage, 0, amt)
+	for i := 0; i < amt; i++ {
+		msg := message.Message{User: "tester", Text: fmt.Sprintf("message %d", i)}
+		msg.SetUserId(1)
+		msg.SetChatId(cId)
+		msg.SetClientId(fmt.Sprintf("client-%d", i))
+		msg.SetEventId(event.NewEventId())
+
+		headers := event.Headers()
+		mb := &sarama.ConsumerMessage{Topic: event.AddedTopic, Offset: int64(i), Value: event.EncodeMessage(msg), Timestamp: time.Now()}
+		for j := range headers {
+			mb.Headers = append(mb.Headers, &headers[j])
+		}
+		mbs = append(mbs, mb)
+	}
+	return mbs
+}
+
+func storedMessages(t *testing.T, db *postgresrepo.PostgresRepo, cId int) map[int64]string {
+	msgs, err := db.GetLastKMessages(cId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[int64]string, len(msgs))
+	for _, msg := range msgs {
+		stored[msg.GetId()] = msg.Text
+	}
+	return stored
+}
+
+func checkStored(t *testing.T, got map[int64]string, want map[int64]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d stored messages, want %d", len(got), len(want))
+	}
+	for id, text := range want {
+		if got[id] != text {
+			t.Fatalf("message %d is %q, want %q", id, got[id], text)
+		}
+	}
+}
+
+func TestRedeliveredRecordsAreStoredOnce(t *testing.T) {
+	mh, db := newTestHandler(t, adapters.BatchSingle)
+	cId := testChatId()
+	mbs := newRecords(cId, 3)
+
+	for _, mb := range mbs {
+		if err := mh.handleMessage(mb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := storedMessages(t, db, cId)
+	if len(first) != len(mbs) {
+		t.Fatalf("got %d stored messages, want %d", len(first), len(mbs))
+	}
+
+	for _, mb := range mbs {
+		if err := mh.handleMessage(mb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStored(t, storedMessages(t, db, cId), first)
+}
+
+func TestRedeliveredBatchesAreStoredOnce(t *testing.T) {
+	for _, mode := range []adapters.BatchMode{adapters.BatchSingle, adapters.BatchInsert, adapters.BatchCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			mh, db := newTestHandler(t, mode)
+			cId := testChatId()
+			mbs := newRecords(cId, 4)
+
+			// the first record is redelivered within the same batch
+			if err := mh.handleBatch(append(mbs[:len(mbs):len(mbs)], mbs[0])); err != nil {
+				t.Fatal(err)
+			}
+			first := storedMessages(t, db, cId)
+			if len(first) != len(mbs) {
+				t.Fatalf("got %d stored messages, want %d", len(first), len(mbs))
+			}
+			for id := int64(1); id <= int64(len(mbs)); id++ {
+				if _, ok := first[id]; !ok {
+					t.Fatalf("message ids are not consecutive: %v", first)
+				}
+			}
+
+			// and the whole batch is redelivered after that with one new record
+			more := append(mbs, newRecords(cId, 1)...)
+			if err := mh.handleBatch(more); err != nil {
+				t.Fatal(err)
+			}
+			got := storedMessages(t, db, cId)
+			first[int64(len(more))] = "message 0"
+			checkStored(t, got, first)
+		})
+	}
+}
@@ -1,20 +1,74 @@
 package kafka
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/IBM/sarama"
+	"go.uber.org/zap"
 )
 
+var ErrorPermanent error = errors.New("record can't be handled")
+var ErrorUnavailable error = errors.New("store is unavailable")
+
 type MessageHandlerFunc func(message *sarama.ConsumerMessage) error
 
+// BatchHandlerFunc stores records all at once, if it fails records are handled one by one
+type BatchHandlerFunc func(messages []*sarama.ConsumerMessage) error
+
+// DeadLetterFunc takes record which failed all attempts, it must return only after record is durably saved
+type DeadLetterFunc func(message *sarama.ConsumerMessage, reason error, attempts int) error
+
+// MaxAttempts limits retries of errors caused by records, unavailable store is retried till session ends,
+// so its outage pauses the claim instead of sending everything to dead letters
+type RetryConfig struct {
+	MaxAttempts int
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{MaxAttempts: 5, MinDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// records are flushed when Size of them is collected or Interval passed since the first one
+type BatchConfig struct {
+	Size     int
+	Interval time.Duration
+}
+
+var DefaultBatchConfig = BatchConfig{Size: 500, Interval: 100 * time.Millisecond}
+
+// marks error which will not go away on retry, such record goes to dead letters at once
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrorPermanent, err)
+}
+
+// marks error of store which is down, it says nothing about record, so record never goes to dead letters because of it
+func Unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrorUnavailable, err)
+}
+
 type Consumer struct {
-	handler MessageHandlerFunc
+	handler      MessageHandlerFunc
+	batchHandler BatchHandlerFunc // nil if records are stored one by one
+	deadLetter   DeadLetterFunc
+	retry        RetryConfig
+	batch        BatchConfig
+	lg           *zap.Logger
 }
 
-func NewConsumer(handler MessageHandlerFunc) *Consumer {
+func NewConsumer(handler MessageHandlerFunc, batchHandler BatchHandlerFunc, deadLetter DeadLetterFunc, retry RetryConfig, batch BatchConfig, lg *zap.Logger) *Consumer {
+	if batchHandler == nil {
+		batch.Size = 1
+	}
 	return &Consumer{
-		handler: handler,
+		handler:      handler,
+		batchHandler: batchHandler,
+		deadLetter:   deadLetter,
+		retry:        retry,
+		batch:        batch,
+		lg:           lg,
 	}
 }
 
@@ -26,22 +80,108 @@ func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
 	return nil
 }
 
+// record which is neither handled nor dead lettered is not marked, so it is consumed again in the next session,
+// offsets are marked only after the whole batch is stored
 func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	batch := make([]*sarama.ConsumerMessage, 0, max(consumer.batch.Size, 1))
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := consumer.handleBatch(session.Context(), batch); err != nil {
+			return err
+		}
+		session.MarkMessage(batch[len(batch)-1], "")
+		batch = batch[:0]
+		return nil
+	}
+
+	timer := time.NewTimer(consumer.batch.Interval)
+	timer.Stop()
+	defer timer.Stop()
 	for {
 		select {
 		case message, ok := <-claim.Messages():
 			if !ok {
-				log.Println("message channel closed")
-				return nil
+				consumer.lg.Info("Message channel closed")
+				return flush()
+			}
+			batch = append(batch, message)
+			if len(batch) == 1 && consumer.batch.Size > 1 {
+				timer.Reset(consumer.batch.Interval)
+			}
+			if len(batch) < consumer.batch.Size {
+				continue
+			}
+			timer.Stop()
+			if err := flush(); err != nil {
+				return err
 			}
-			err := consumer.handler(message)
-			if err != nil {
-				log.Fatal(err)
+		case <-timer.C:
+			if err := flush(); err != nil {
+				return err
 			}
-			session.MarkMessage(message, "")
 		case <-session.Context().Done():
-			session.Commit()
+			session.Commit() // unflushed records are consumed again
 			return nil
 		}
 	}
 }
+
+// batch is retried as a whole, then its records are handled one by one, so only failing ones go to dead letters
+func (consumer *Consumer) handleBatch(ctx context.Context, batch []*sarama.ConsumerMessage) error {
+	if consumer.batchHandler != nil && len(batch) > 1 {
+		err := consumer.withRetries(ctx, batch[0], func() error { return consumer.batchHandler(batch) })
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		consumer.lg.Warn("Failed to handle batch, handle records one by one", zap.Error(err), zap.Int("batch size", len(batch)), zap.Int64("first offset", batch[0].Offset))
+	}
+
+	for _, message := range batch {
+		if err := consumer.handle(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (consumer *Consumer) handle(ctx context.Context, message *sarama.ConsumerMessage) error {
+	attempts := 0
+	err := consumer.withRetries(ctx, message, func() error {
+		attempts++
+		return consumer.handler(message)
+	})
+	if err == nil || ctx.Err() != nil || consumer.deadLetter == nil {
+		return err
+	}
+	return consumer.deadLetter(message, err, attempts)
+}
+
+// returns the last error if fn failed all attempts or failed permanently, attempts failed because store is unavailable
+// are not counted, so they are retried till ctx is done
+func (consumer *Consumer) withRetries(ctx context.Context, message *sarama.ConsumerMessage, fn func() error) error {
+	delay := consumer.retry.MinDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrorUnavailable) {
+			attempt--
+		} else if errors.Is(err, ErrorPermanent) || attempt >= consumer.retry.MaxAttempts {
+			return err
+		}
+
+		consumer.lg.Warn("Failed to handle record, retry", zap.Error(err), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Int64("offset", message.Offset))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, consumer.retry.MaxDelay)
+	}
+}
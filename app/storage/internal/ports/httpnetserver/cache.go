@@ -0,0 +1,49 @@
+package httpnetserver
+
+import (
+	"server/external/adapters/postgresrepo"
+	"server/external/message"
+
+	"go.uber.org/zap"
+)
+
+// newest messages are served from cache, on miss they are read from db and put to cache
+func (s *server) lastMessages(cId int, amt int) ([]message.Message, error) {
+	msgs, ok, err := s.mh.Cdb.GetLastKMessages(cId, amt)
+	if err != nil {
+		s.mh.Cdb.InvalidateChat(cId) // broken page is filled again from db
+	}
+	if err == nil && ok {
+		s.lg.Debug("Newbie messages are got from cache", zap.Int("conference_id", cId), zap.Int("msgs amount", len(msgs)))
+		return msgs, nil
+	}
+
+	msgs, err = s.mh.Db.GetLastKMessages(cId, amt)
+	if err != nil {
+		return nil, err
+	}
+	s.mh.Cdb.SetMessages(cId, msgs)
+	return msgs, nil
+}
+
+// one page of messages newer than lMsgId, the same as db returns.
+// only page which reaches the newest message is cached, an older one would look like the newest page of chat
+func (s *server) newerMessages(cId int, lMsgId int64) ([]message.Message, error) {
+	msgs, ok, err := s.mh.Cdb.GetNewerMessages(cId, lMsgId, postgresrepo.NewerMessagesPageSize)
+	if err != nil {
+		s.mh.Cdb.InvalidateChat(cId)
+	}
+	if err == nil && ok {
+		s.lg.Debug("New messages are got from cache", zap.Int("conference_id", cId), zap.Int("msgs amount", len(msgs)))
+		return msgs, nil
+	}
+
+	msgs, err = s.mh.Db.GetNewerMessages(cId, lMsgId)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) < postgresrepo.NewerMessagesPageSize {
+		s.mh.Cdb.SetMessages(cId, msgs)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,123 @@
+package httpnetserver
+
+import (
+	"context"
+	"testing"
+
+	"server/external/adapters/postgresrepo"
+	"server/external/message"
+	"storage/internal/cache_adapters"
+	"storage/internal/cache_adapters/memoryrepo"
+	"storage/internal/consumer"
+
+	"go.uber.org/zap"
+)
+
+// chatDb keeps messages of one chat with ids from 1 and answers like postgres does
+type chatDb struct {
+	msgs []message.Message
+}
+
+func newChatDb(cId int, amt int) *chatDb {
+	db := &chatDb{}
+	for id := int64(1); id <= int64(amt); id++ {
+		var msg message.Message
+		msg.SetId(id)
+		msg.SetChatId(cId)
+		db.msgs = append(db.msgs, msg)
+	}
+	return db
+}
+
+func (db *chatDb) AddMessage(*message.Message, func(error)) error {
+	return nil
+}
+
+func (db *chatDb) GetNewerMessages(cId int, lMsgId int64) ([]message.Message, error) {
+	start := min(int(max(lMsgId, 0)), len(db.msgs))
+	return db.msgs[start:min(start+postgresrepo.NewerMessagesPageSize, len(db.msgs))], nil
+}
+
+func (db *chatDb) GetLastKMessages(cId int, k int) ([]message.Message, error) {
+	msgs := make([]message.Message, 0, k)
+	for i := len(db.msgs) - 1; i >= 0 && len(msgs) < k; i-- {
+		msgs = append(msgs, db.msgs[i])
+	}
+	return msgs, nil
+}
+
+func (db *chatDb) GetOlderMessages(int, int64, int) ([]message.Message, error) {
+	return nil, nil
+}
+
+func (db *chatDb) CloseRepo() error {
+	return nil
+}
+
+func checkLast(t *testing.T, msgs []message.Message, lastId int64, k int) {
+	t.Helper()
+	if len(msgs) != k {
+		t.Fatalf("got %d last messages, want %d", len(msgs), k)
+	}
+	for i, msg := range msgs {
+		if msg.GetId() != lastId-int64(i) {
+			t.Fatalf("last message %d has id %d, want %d", i, msg.GetId(), lastId-int64(i))
+		}
+	}
+}
+
+// page of the newest messages expires, then a catch-up reads old messages through cache,
+// they must not be served as the newest ones afterwards
+func TestOldPageIsNotServedAsLast(t *testing.T) {
+	const cId, amt, k = 7, 150, 10
+	lg := zap.NewNop()
+	db := newChatDb(cId, amt)
+	cdb := memoryrepo.NewRepo(cache_adapters.DefaultConfig, lg)
+	s := newServer(consumer.NewMessageHandler(context.Background(), db, nil, "", cdb, nil, nil, lg), nil)
+
+	msgs, err := s.lastMessages(cId, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLast(t, msgs, amt, k)
+	cdb.InvalidateChat(cId) // page expired, last id of chat is kept
+
+	page, err := s.newerMessages(cId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != postgresrepo.NewerMessagesPageSize {
+		t.Fatalf("got page of %d messages, want %d", len(page), postgresrepo.NewerMessagesPageSize)
+	}
+	if _, ok, _ := cdb.GetNewerMessages(cId, 0, postgresrepo.NewerMessagesPageSize); ok {
+		t.Fatal("page which doesn't reach the newest message is cached")
+	}
+	msgs, err = s.lastMessages(cId, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLast(t, msgs, amt, k)
+
+	// old page got to cache anyway, e.g. by a concurrent write, it is still not the newest one
+	cdb.InvalidateChat(cId)
+	cdb.SetMessages(cId, page)
+	if _, ok, _ := cdb.GetLastKMessages(cId, k); ok {
+		t.Fatal("cached page which is older than the last message of chat is served as the newest one")
+	}
+	msgs, err = s.lastMessages(cId, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLast(t, msgs, amt, k)
+
+	// the last page of catch-up reaches the newest message, so it is cached and served
+	cdb.InvalidateChat(cId)
+	if _, err = s.newerMessages(cId, amt-k); err != nil {
+		t.Fatal(err)
+	}
+	msgs, ok, _ := cdb.GetLastKMessages(cId, k)
+	if !ok {
+		t.Fatal("page which reaches the newest message is not served from cache")
+	}
+	checkLast(t, msgs, amt, k)
+}
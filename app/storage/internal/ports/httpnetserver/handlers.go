@@ -3,7 +3,11 @@ package httpnetserver
 import (
 	"context"
 	"errors"
+	"math"
 	"net/http"
+	"net/url"
+	"server/external/adapters"
+	"server/external/message"
 	strorage_response "storage/external/api_response"
 	"storage/internal/consumer"
 	"strconv"
@@ -12,51 +16,87 @@ import (
 )
 
 var ErrorFailedToParseMsgAmt error = errors.New("Failed to parse message newbie amount")
+var ErrorFailedToParseChatId error = errors.New("Failed to parse conference id")
+var ErrorFailedToParseMsgId error = errors.New("Failed to parse message id")
+var ErrorMethodNotAllowed error = errors.New("Method is not allowed")
+
+const MaxMsgsAmt = 100
 
 type server struct {
 	ctx *context.Context
 	mh  *consumer.MessageHandler
+	udb adapters.UserRepository
 	lg  *zap.Logger
 }
 
-func newServer(mh *consumer.MessageHandler) *server {
-	return &server{&mh.Ctx, mh, mh.Lg.With(zap.String("port", "httpserver"))}
+func newServer(mh *consumer.MessageHandler, udb adapters.UserRepository) *server {
+	return &server{&mh.Ctx, mh, udb, mh.Lg.With(zap.String("port", "httpserver"))}
+}
+
+func parseChatId(qs url.Values) (int, error) {
+	cId, err := strconv.Atoi(qs.Get("conference_id"))
+	if err != nil || cId < 0 {
+		return 0, ErrorFailedToParseChatId
+	}
+	return cId, nil
+}
+
+func parseMsgsAmt(qs url.Values) (int, error) {
+	amt, err := strconv.Atoi(qs.Get("amount"))
+	if err != nil || amt < 0 || amt > MaxMsgsAmt {
+		return 0, ErrorFailedToParseMsgAmt
+	}
+	return amt, nil
+}
+
+// returns the biggest id among msgs or lMsgId if there is no bigger one
+func lastMessageId(msgs []message.Message, lMsgId int64) int64 {
+	for _, msg := range msgs {
+		lMsgId = max(lMsgId, msg.GetId())
+	}
+	return lMsgId
 }
 
 func (s *server) getNewMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
-	cId := qs.Get("conference_id")
-	lMsgTimeStamp, err := strconv.ParseInt(qs.Get("last_message_time_stamp"), 10, 64)
+	cId, err := parseChatId(qs)
+	if err != nil {
+		s.lg.Warn("Failed to parse conference id", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	lMsgId, err := strconv.ParseInt(qs.Get("last_message_id"), 10, 64)
 	if err != nil {
-		s.lg.Warn("Failed to parse message time stamp", zap.Error(err))
+		s.lg.Warn("Failed to parse last message id", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	s.lg.Debug("Server asked for new messages", zap.String("conference_id", cId))
+	s.lg.Debug("Server asked for new messages", zap.Int("conference_id", cId))
 
-	ok, err := s.mh.Cdb.CheckLastMsgTimeStamp(cId, lMsgTimeStamp)
+	ok, err := s.mh.Cdb.CheckLastMsgId(cId, lMsgId)
 	if err != nil {
-		s.lg.Error("Failed to check new messages in cache db", zap.Error(err))
+		s.lg.Error("Failed to check new messages in cache db, ask db", zap.Error(err))
+		ok = true
 	}
 
 	if !ok {
-		s.lg.Debug("No new messages found", zap.String("conference_id", cId))
+		s.lg.Debug("No new messages found", zap.Int("conference_id", cId))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte{})
 		return
 	}
 
-	s.mh.Db.SetLastMessageTimeStamp(lMsgTimeStamp)
-	msgs, err := s.mh.Db.GetNewerMessages()
+	msgs, err := s.newerMessages(cId, lMsgId)
 	if err != nil {
 		s.lg.Warn("Failed to get new messages", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError) // change
 		return
 	}
 
-	buf, err := strorage_response.EncodeResponseToBytes(strorage_response.NewResponse(msgs, s.mh.Db.GetLastMessageTimeStamp()))
+	buf, err := strorage_response.EncodeResponseToBytes(strorage_response.NewResponse(msgs, lastMessageId(msgs, lMsgId)))
 	if err != nil {
 		s.lg.Warn("Failed to conv messages to bytes", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -70,22 +110,29 @@ func (s *server) getNewMessagesHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) getNewbieMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
-	amt, err := strconv.Atoi(qs.Get("amount"))
-	if amt < 0 || amt > 100 || err != nil { // bad const 100 change !!!
+	cId, err := parseChatId(qs)
+	if err != nil {
+		s.lg.Warn("Failed to parse conference id", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	amt, err := parseMsgsAmt(qs)
+	if err != nil {
 		s.lg.Warn("Failed to parse message amount", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	s.lg.Debug("Server asked for newbie messages", zap.Int("amount msgs", amt))
-	msgs, err := s.mh.Db.GetLastKMessages(amt)
+	s.lg.Debug("Server asked for newbie messages", zap.Int("conference_id", cId), zap.Int("amount msgs", amt))
+	msgs, err := s.lastMessages(cId, amt)
 	if err != nil {
 		s.lg.Warn("Failed to get new messages", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError) // change
 		return
 	}
 
-	buf, err := strorage_response.EncodeResponseToBytes(strorage_response.NewResponse(msgs, s.mh.Db.GetLastMessageTimeStamp()))
+	buf, err := strorage_response.EncodeResponseToBytes(strorage_response.NewResponse(msgs, lastMessageId(msgs, -1)))
 	if err != nil {
 		s.lg.Warn("Failed to conv response to bytes", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -95,3 +142,49 @@ func (s *server) getNewbieMessagesHandler(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
 	w.Write(buf)
 }
+
+func (s *server) getHistoryMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	cId, err := parseChatId(qs)
+	if err != nil {
+		s.lg.Warn("Failed to parse conference id", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	amt, err := parseMsgsAmt(qs)
+	if err != nil {
+		s.lg.Warn("Failed to parse message amount", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	bMsgId, err := strconv.ParseInt(qs.Get("before_message_id"), 10, 64)
+	if err != nil {
+		s.lg.Warn("Failed to parse before message id", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(ErrorFailedToParseMsgId.Error()))
+		return
+	}
+	if bMsgId <= 0 {
+		bMsgId = math.MaxInt64
+	}
+
+	s.lg.Debug("Server asked for history messages", zap.Int("conference_id", cId), zap.Int64("before message id", bMsgId), zap.Int("amount msgs", amt))
+	msgs, err := s.mh.Db.GetOlderMessages(cId, bMsgId, amt)
+	if err != nil {
+		s.lg.Warn("Failed to get history messages", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := strorage_response.EncodeResponseToBytes(strorage_response.NewResponse(msgs, lastMessageId(msgs, -1)))
+	if err != nil {
+		s.lg.Warn("Failed to conv response to bytes", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.lg.Debug("Successfully send history messages to server", zap.Int("msgs amount", len(msgs)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
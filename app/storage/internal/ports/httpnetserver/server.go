@@ -2,18 +2,22 @@ package httpnetserver
 
 import (
 	"net/http"
+	"server/external/adapters"
 	"storage/internal/consumer"
 
 	"go.uber.org/zap"
 )
 
-func RunServer(addr string, mh *consumer.MessageHandler) {
+func RunServer(addr string, mh *consumer.MessageHandler, udb adapters.UserRepository) {
 	var httpSrv http.Server
 	httpSrv.Addr = addr
-	s := newServer(mh)
+	s := newServer(mh, udb)
 
 	http.HandleFunc("/get", http.HandlerFunc(s.getNewMessagesHandler))
 	http.HandleFunc("/get_newbie", http.HandlerFunc(s.getNewbieMessagesHandler))
+	http.HandleFunc("/get_history", http.HandlerFunc(s.getHistoryMessagesHandler))
+	http.HandleFunc("/register", http.HandlerFunc(s.registerHandler))
+	http.HandleFunc("/login", http.HandlerFunc(s.loginHandler))
 
 	mh.Eg.Go(func() error {
 		<-mh.Ctx.Done()
@@ -0,0 +1,101 @@
+package httpnetserver
+
+import (
+	"net/http"
+	"server/external/account"
+	strorage_response "storage/external/api_response"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentials are sent as post form with name and password
+func parseCredentials(r *http.Request) (string, string, error) {
+	if r.Method != http.MethodPost {
+		return "", "", ErrorMethodNotAllowed
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", "", err
+	}
+	name, password := r.PostForm.Get("name"), r.PostForm.Get("password")
+	if err := account.ValidateCredentials(name, password); err != nil {
+		return "", "", err
+	}
+	return name, password, nil
+}
+
+func (s *server) writeUser(w http.ResponseWriter, u account.User) {
+	buf, err := strorage_response.EncodeUserResponseToBytes(strorage_response.NewUserResponse(u))
+	if err != nil {
+		s.lg.Warn("Failed to conv user response to bytes", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func (s *server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	name, password, err := parseCredentials(r)
+	if err != nil {
+		s.lg.Warn("Failed to parse credentials", zap.Error(err))
+		w.WriteHeader(credentialsErrStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		s.lg.Error("Failed to hash password", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u, err := s.udb.AddUser(name, pHash)
+	if err == account.ErrorUserExists {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.lg.Info("Registered new user", zap.Int("user id", u.Id))
+	s.writeUser(w, u)
+}
+
+func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	name, password, err := parseCredentials(r)
+	if err != nil {
+		s.lg.Warn("Failed to parse credentials", zap.Error(err))
+		w.WriteHeader(credentialsErrStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	u, pHash, err := s.udb.GetUser(name)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword(pHash, []byte(password))
+	}
+	if err == account.ErrorWrongCredentials || err == bcrypt.ErrMismatchedHashAndPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(account.ErrorWrongCredentials.Error()))
+		return
+	}
+	if err != nil {
+		s.lg.Error("Failed to check user credentials", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeUser(w, u)
+}
+
+func credentialsErrStatus(err error) int {
+	if err == ErrorMethodNotAllowed {
+		return http.StatusMethodNotAllowed
+	}
+	return http.StatusBadRequest
+}